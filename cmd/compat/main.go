@@ -0,0 +1,137 @@
+// Command compat runs test ROMs headlessly for a fixed number of cycles (or, with -settle, until
+// the screen stops changing) and compares the final screen against a stored expected result, e.g.
+//
+//	go run ./cmd/compat roms/IBM_Logo.ch8 roms/test_opcode.ch8
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/JoshCooperr/chip8/pkg/headless"
+	"github.com/JoshCooperr/chip8/pkg/vm"
+)
+
+var (
+	cycles   = flag.Int("cycles", 10000, "number of cycles to run each ROM for")
+	expected = flag.String("expected", "roms/expected", "directory containing the expected screens")
+	update   = flag.Bool("update", false, "overwrite the expected screens with the actual results")
+	settle   = flag.Int("settle", 0, "if nonzero, stop a ROM early once its screen is unchanged for this many checks")
+	coverage = flag.Bool("coverage", false, "print the opcode forms each ROM executed")
+	pngDir   = flag.String("png", "", "if set, also write the final screen of each ROM as a PNG to this directory")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: compat [flags] rom...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, rom := range flag.Args() {
+		if err := check(rom); err != nil {
+			fmt.Printf("FAIL %s: %v\n", rom, err)
+			failed = true
+		} else {
+			fmt.Printf("PASS %s\n", rom)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check runs rom and compares its final screen with the expected result
+func check(rom string) error {
+	renderer := &headless.Renderer{}
+	chip8 := &vm.VM{}
+	chip8.Init(renderer, vm.WithCoverage(*coverage))
+	if err := chip8.LoadROM(rom); err != nil {
+		return err
+	}
+	if err := run(chip8); err != nil {
+		return err
+	}
+	actual := headless.Text(renderer.Frame)
+	if *coverage {
+		printCoverage(rom, chip8.CoverageReport())
+	}
+
+	name := strings.TrimSuffix(filepath.Base(rom), filepath.Ext(rom))
+	if *pngDir != "" {
+		if err := writePNG(filepath.Join(*pngDir, name+".png"), renderer.Frame); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(*expected, name+".txt")
+	if *update {
+		return os.WriteFile(path, []byte(actual), 0644)
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(want) != actual {
+		return fmt.Errorf("screen differs from %s, got:\n%s", path, actual)
+	}
+	return nil
+}
+
+// settleInterval is the number of cycles between checks of whether the screen has settled
+const settleInterval = 1000
+
+// run executes up to -cycles cycles, stopping early if the ROM exits or, with -settle, once the
+// screen has stopped changing
+func run(chip8 *vm.VM) error {
+	if *settle <= 0 {
+		return ignoreHalt(chip8.RunCycles(*cycles))
+	}
+	last, unchanged := chip8.FrameHash(), 0
+	for done := 0; done < *cycles && unchanged < *settle; done += settleInterval {
+		if err := chip8.RunCycles(settleInterval); err != nil {
+			return ignoreHalt(err)
+		}
+		hash := chip8.FrameHash()
+		if hash == last {
+			unchanged++
+		} else {
+			last, unchanged = hash, 0
+		}
+	}
+	return nil
+}
+
+// ignoreHalt returns err unless it is the ROM exiting, which is a normal end to the run
+func ignoreHalt(err error) error {
+	if errors.Is(err, vm.ErrHalt) {
+		return nil
+	}
+	return err
+}
+
+func printCoverage(rom string, report map[string]bool) {
+	forms := make([]string, 0, len(report))
+	for form := range report {
+		forms = append(forms, form)
+	}
+	sort.Strings(forms)
+	fmt.Printf("%s executed %d opcode forms: %s\n", rom, len(forms), strings.Join(forms, " "))
+}
+
+func writePNG(path string, pixels [64][32]byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, headless.Image(pixels, 8))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/JoshCooperr/chip8/pkg/vm"
+)
+
+// Instructions listed before and after the PC by the list command
+const (
+	debugListBefore = 5
+	debugListAfter  = 10
+)
+
+// debugConsole reads debugger commands from stdin and applies them to chip8
+func debugConsole(chip8 *vm.VM) {
+	fmt.Println("debugger: s(tep) [n], skip, b(ack), c(ontinue), p(ause), m(ark), d(iff), w(atch) <reg>, t(imers), l(ist), subs, j(ump) <addr>")
+	chip8.SetRegisterWatchHook(func(reg int, old, new uint8, pc uint16) {
+		fmt.Printf("%#04x: V%X %#02x -> %#02x\n", pc, reg, old, new)
+	})
+	// Snapshot to diff memory against, taken by the mark command
+	mark := chip8.Snapshot()
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "s", "step":
+			n, err := parseCount(fields)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if done, err := chip8.StepN(n); err != nil {
+				fmt.Println(err)
+			} else if done < n {
+				fmt.Printf("breakpoint after %d steps\n", done)
+			}
+			printPC(chip8)
+		case "skip":
+			chip8.Skip()
+			printPC(chip8)
+		case "b", "back":
+			if err := chip8.StepBack(); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			printPC(chip8)
+		case "c", "continue":
+			chip8.Resume()
+		case "p", "pause":
+			chip8.Pause()
+			printPC(chip8)
+		case "m", "mark":
+			mark = chip8.Snapshot()
+		case "d", "diff":
+			for _, d := range vm.DiffMemory(mark, chip8.Snapshot()) {
+				fmt.Printf("%#04x: %#02x -> %#02x\n", d.Addr, d.Before, d.After)
+			}
+		case "w", "watch":
+			reg, err := parseRegister(fields)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if err := chip8.WatchRegister(reg); err != nil {
+				fmt.Println(err)
+			}
+		case "l", "list":
+			for _, line := range chip8.DisassembleWindow(debugListBefore, debugListAfter) {
+				fmt.Println(line)
+			}
+		case "subs":
+			for _, addr := range chip8.Subroutines() {
+				fmt.Printf("%#04x\n", addr)
+			}
+		case "j", "jump":
+			addr, err := parseAddress(fields)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if !chip8.Paused() {
+				fmt.Println("pause before jumping")
+				continue
+			}
+			chip8.SetPC(addr)
+			printPC(chip8)
+		case "t", "timers":
+			if chip8.TimersPaused() {
+				chip8.ResumeTimers()
+				fmt.Println("timers running")
+			} else {
+				chip8.PauseTimers()
+				fmt.Println("timers frozen")
+			}
+		default:
+			fmt.Println("unknown command")
+		}
+	}
+}
+
+// printPC prints the address and disassembly of the next instruction, read together so they
+// agree even while the VM is running
+func printPC(chip8 *vm.VM) {
+	for _, line := range chip8.DisassembleWindow(0, 0) {
+		fmt.Printf("%#04x: %s\n", line.Addr, line.Mnemonic)
+	}
+}
+
+// parseCount parses the optional count argument of a command, 1 if it's missing
+func parseCount(fields []string) (int, error) {
+	if len(fields) < 2 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("usage: %s [count]", fields[0])
+	}
+	return n, nil
+}
+
+// parseAddress parses the address (hex, with or without a leading 0x) argument of a command
+func parseAddress(fields []string) (uint16, error) {
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("usage: %s <address>", fields[0])
+	}
+	addr, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(fields[1]), "0x"), 16, 12)
+	if err != nil {
+		return 0, fmt.Errorf("bad address %q", fields[1])
+	}
+	return uint16(addr), nil
+}
+
+// parseRegister parses the register number (hex, with or without a leading V) argument of a
+// command
+func parseRegister(fields []string) (int, error) {
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("usage: %s <register>", fields[0])
+	}
+	reg, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "V"), 16, 4)
+	if err != nil {
+		return 0, fmt.Errorf("bad register %q", fields[1])
+	}
+	return int(reg), nil
+}
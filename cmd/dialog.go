@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/JoshCooperr/chip8/pkg/display"
+)
+
+// dialogCommands are the native file dialogs to try, in order, to open a ROM. Each prints the
+// chosen path, or exits with an error if the user cancels
+var dialogCommands = [][]string{
+	{"zenity", "--file-selection", "--title=Open ROM", "--file-filter=CHIP-8 ROMs | *.ch8 *.c8 *.xo8", "--file-filter=All files | *"},
+	{"kdialog", "--title", "Open ROM", "--getopenfilename", ".", "*.ch8 *.c8 *.xo8|CHIP-8 ROMs"},
+}
+
+// openFileDialog shows a native file dialog and returns the ROM chosen, or "" if the user
+// cancelled
+func openFileDialog() (string, error) {
+	commands := dialogCommands
+	if runtime.GOOS == "darwin" {
+		commands = [][]string{{"osascript", "-e", `POSIX path of (choose file with prompt "Open ROM")`}}
+	}
+	for _, c := range commands {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(c[0], c[1:]...).Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// Cancelled
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", errors.New("no file dialog available, install zenity or kdialog, or pass -rom")
+}
+
+// chooseROM shows a placeholder screen in the window while the user picks a ROM with a file
+// dialog, returning "" if they cancel or close the window
+func chooseROM(d *display.Display) (string, error) {
+	type result struct {
+		path string
+		err  error
+	}
+	chosen := make(chan result, 1)
+	go func() {
+		path, err := openFileDialog()
+		chosen <- result{path, err}
+	}()
+
+	screen := textScreen("NO ROM")
+	for !d.Closed() {
+		select {
+		case r := <-chosen:
+			return r.path, r.err
+		default:
+		}
+		d.Render(screen)
+		time.Sleep(time.Second / 60)
+	}
+	return "", nil
+}
+
+// glyphs is a 4x5 pixel font for the few letters textScreen needs
+var glyphs = map[rune][5]string{
+	'N': {"#..#", "##.#", "#.##", "#..#", "#..#"},
+	'O': {".##.", "#..#", "#..#", "#..#", ".##."},
+	'R': {"###.", "#..#", "###.", "#.#.", "#..#"},
+	'M': {"#..#", "####", "#..#", "#..#", "#..#"},
+	' ': {"....", "....", "....", "....", "...."},
+}
+
+// textScreen returns a screen with text written across the middle of it
+func textScreen(text string) [64][32]byte {
+	var screen [64][32]byte
+	const glyphWidth = 5 // Including the space between letters
+	left := (64 - len(text)*glyphWidth) / 2
+	top := (32 - 5) / 2
+	for i, r := range text {
+		for y, row := range glyphs[r] {
+			for x, c := range row {
+				if c == '#' {
+					screen[left+i*glyphWidth+x][top+y] = 1
+				}
+			}
+		}
+	}
+	return screen
+}
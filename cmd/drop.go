@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JoshCooperr/chip8/pkg/display"
+	"github.com/JoshCooperr/chip8/pkg/settings"
+	"github.com/JoshCooperr/chip8/pkg/vm"
+)
+
+// watchDrops loads ROMs dropped onto the window in place of the running one
+func watchDrops(d *display.Display, chip8 *vm.VM) {
+	for range time.Tick(100 * time.Millisecond) {
+		for _, path := range d.Dropped() {
+			if err := loadDropped(chip8, path); err != nil {
+				log.Printf("can't load %s: %v", path, err)
+				setStatus(fmt.Sprintf("can't load %s: %v", filepath.Base(path), err))
+				continue
+			}
+			setROMName(filepath.Base(path))
+			if err := settings.AddRecentROM(path); err != nil {
+				log.Printf("can't save recent ROMs: %v", err)
+			}
+		}
+	}
+}
+
+// loadDropped replaces the running ROM with the one at path. The file is checked before the
+// running ROM is reset, so a bad file leaves it running
+func loadDropped(chip8 *vm.VM, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("the file is empty")
+	}
+	if max := vm.MaxROMSize; len(data) > max {
+		return fmt.Errorf("the file is %d bytes, larger than the %d bytes available", len(data), max)
+	}
+
+	paused := chip8.Paused()
+	chip8.Pause()
+	chip8.Reset()
+	err = chip8.LoadROMBytes(data)
+	if !paused {
+		chip8.Resume()
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+
+	"github.com/JoshCooperr/chip8/pkg/headless"
+	"github.com/JoshCooperr/chip8/pkg/settings"
+)
+
+// headlessWindow stands in for the display window with -headless, keeping frames in memory. The
+// run loop stops when it's closed, which happens on an interrupt
+type headlessWindow struct {
+	headless.Renderer
+	closed int32
+}
+
+func (w *headlessWindow) Closed() bool {
+	return atomic.LoadInt32(&w.closed) != 0
+}
+
+// runHeadless runs the ROM without opening a window (so without needing a display or
+// pixelgl.Run), until it stops or the process is interrupted, then prints the final screen
+func runHeadless() error {
+	if recent := settings.RecentROMs(); *romPath == "" && *lastROM && len(recent) > 0 {
+		*romPath = recent[0]
+	}
+	if *romPath == "" && *loadPath == "" {
+		return errors.New("-headless needs a ROM, given by -rom, -last or -loadstate")
+	}
+	window := &headlessWindow{}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		<-interrupt
+		atomic.StoreInt32(&window.closed, 1)
+	}()
+
+	chip8, cleanup, err := newVM(window, nil)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	err = runVM(chip8)
+	if window.Hires {
+		fmt.Print(headless.HiresText(window.HiresFrame))
+	} else {
+		fmt.Print(headless.Text(window.Frame))
+	}
+	return err
+}
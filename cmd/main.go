@@ -1,14 +1,93 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/JoshCooperr/chip8/pkg/audio"
 	"github.com/JoshCooperr/chip8/pkg/display"
+	"github.com/JoshCooperr/chip8/pkg/headless"
+	"github.com/JoshCooperr/chip8/pkg/settings"
 	"github.com/JoshCooperr/chip8/pkg/vm"
 	"github.com/faiface/pixel/pixelgl"
 )
 
+var (
+	romPath     = flag.String("rom", "", "path or URL of the ROM to run, if empty choose one with a file dialog")
+	lastROM     = flag.Bool("last", false, "if -rom is empty, run the most recently opened ROM")
+	listRecent  = flag.Bool("recent", false, "list the recently opened ROMs, then exit")
+	saveProfile = flag.Bool("saveprofile", false, "remember the clock and compatibility settings for this ROM")
+	xoChip      = flag.Bool("xochip", false, "enable the XO-CHIP instruction set extensions")
+	cheats      = flag.String("cheats", "", "comma separated memory patches to hold, e.g. 0x2F0=9,0x2F1=0")
+	hires       = flag.Bool("hires", false, "run ROMs that begin with the HIRES startup code in 64x64 mode")
+	beepCollide = flag.Bool("beeponcollision", false, "ring the terminal bell whenever sprites collide")
+	logOverflow = flag.Bool("logoverflow", false, "log when adding to a register overflows")
+	logBorrow   = flag.Bool("logborrow", false, "log when subtracting from a register borrows")
+	logSound    = flag.Bool("logsound", false, "log when the sound timer starts and stops")
+	pauseOnBlur = flag.Bool("pauseonblur", false, "pause emulation while the window is unfocused")
+	startDelay  = flag.Int("startdelay", 0, "number of 60Hz frames to wait after the window opens before starting the ROM")
+	throttle    = flag.Bool("throttle", false, "render at most once per 60Hz frame")
+	clockSpeed  = flag.Int("clock", 700, "number of cycles to execute per second")
+	autoClock   = flag.Bool("autoclock", false, "unless -clock is set, tune the clock speed to the ROM with a short calibration run")
+	perFrame    = flag.Int("cyclesperframe", 0, "if nonzero, run this many cycles per 60Hz frame")
+	drawCost    = flag.Int("drawcost", 0, "extra cycles each sprite draw (DXYN) takes, as on real hardware")
+	vsync       = flag.Bool("vsync", true, "synchronise rendering with the monitor refresh rate")
+	maxFPS      = flag.Int("maxfps", 60, "maximum frames per second when -vsync=false, 0 for no cap")
+	intScale    = flag.Bool("integerscale", false, "scale the screen by whole numbers only")
+	flipX       = flag.Bool("flipx", false, "mirror the screen horizontally")
+	flipY       = flag.Bool("flipy", false, "mirror the screen vertically")
+	scanlines   = flag.Float64("scanlines", 0, "darken alternate scanlines by this much, from 0 (off) to 1")
+	brightness  = flag.Float64("brightness", 0, "brightness adjustment, from -1 to 1")
+	contrast    = flag.Float64("contrast", 1, "contrast multiplier, 1 for the original colours")
+	hiContrast  = flag.Bool("highcontrast", false, "draw in a high contrast palette")
+	showKeypad  = flag.Bool("showkeypad", false, "draw the keypad below the screen, showing which keys are held")
+	logKeys     = flag.Bool("logkeys", false, "log every key press and release")
+	debounce    = flag.Duration("debounce", 0, "ignore a key changing state within this long of its last change")
+	keyRepeat   = flag.Duration("keyrepeat", 0, "if nonzero, repeat a held key for key waits after this long")
+	bell        = flag.Bool("bell", false, "ring the terminal bell when the ROM beeps")
+	minBeep     = flag.Duration("minbeep", 0, "minimum duration of a beep, e.g. 50ms, to smooth out clicks")
+	recoverROM  = flag.Bool("recover", true, "report a crash in the emulated ROM as an error rather than a panic")
+	recordPath  = flag.String("recordaudio", "", "record every beep to this WAV file, instead of playing it")
+	ppmPath     = flag.String("ppm", "", "write every frame rendered to this file as a PPM stream, e.g. for ffmpeg to make a video")
+	tracePath   = flag.String("trace", "", "write a trace of every instruction executed to this file")
+	loadPath    = flag.String("loadstate", "", "start from the state saved in this file instead of loading a ROM")
+	savePath    = flag.String("savestate", "", "save the state to this file when F5 is pressed")
+	verifyPath  = flag.String("verifytrace", "", "check the ROM reproduces the trace in this file, then exit")
+	disasmPath  = flag.String("disasm", "", "write the disassembly of the ROM to this file, then exit")
+	frameStats  = flag.Bool("framestats", false, "on exit, print how many instructions ran between renders")
+	memFill     = flag.String("fill", "zero", "what memory and registers hold at startup: zero, ones or random:<seed>")
+	strict      = flag.Bool("strict", false, "stop with an error at any opcode the emulator doesn't support")
+	protect     = flag.Bool("protectreserved", false, "stop with an error when the ROM writes to the reserved memory below 0x200")
+	ignore00NN  = flag.Bool("ignore00nn", false, "log and ignore unknown 00NN opcodes instead of stopping with an error")
+	ignoreFXNN  = flag.Bool("ignorefxnn", false, "log and ignore unknown FXNN opcodes instead of stopping with an error")
+	pauseUnimpl = flag.Bool("pauseonunimplemented", false, "pause at unsupported opcodes instead of stopping, e.g. to inspect them with -debug")
+	dryDraw     = flag.Bool("drydraw", false, "log where each sprite would be drawn, and which pixels wrap or clip, instead of drawing")
+	quirkWarn   = flag.Bool("quirkwarnings", false, "log the first use of each quirk-dependent instruction")
+	debugAddr   = flag.String("debugserver", "", "if set, serve the debug protocol over TCP on this address, e.g. localhost:6502")
+	noWindow    = flag.Bool("headless", false, "run without opening a window, printing the final screen when the ROM stops or on interrupt")
+	debug       = flag.Bool("debug", false, "start paused, controlled by debugger commands on stdin")
+)
+
+// Number of instructions the debugger can step back through
+const debugHistory = 1000
+
+// Size of each CHIP-8 pixel in the frames written by -ppm
+const ppmScale = 8
+
+// Sample rate of the WAV file written by -recordaudio
+const recordRate = 44100
+
 func RandBool() bool {
 	rand.Seed(time.Now().UnixNano())
 	return rand.Intn(2) == 1
@@ -31,17 +110,495 @@ func RandBool() bool {
 // 	}
 // }
 
-func test() {
-	display, err := display.NewDisplay()
+func test() error {
+	// The VM the save state hotkey saves, once it's running
+	var chip8 *vm.VM
+	var hotkeys []display.Option
+	if *savePath != "" {
+		hotkeys = append(hotkeys, display.WithHotkey(saveStateKey, func() {
+			// Hotkeys are handled each frame, even while paused, but with the VM locked while
+			// it's running, so save once it's released
+			if chip8 != nil {
+				go saveState(chip8, *savePath)
+			}
+		}))
+	}
+	display, err := display.NewDisplay(append([]display.Option{
+		display.WithVSync(*vsync),
+		display.WithMaxFPS(*maxFPS),
+		display.WithIntegerScaling(*intScale),
+		display.WithFlipX(*flipX),
+		display.WithFlipY(*flipY),
+		display.WithScanlines(*scanlines),
+		display.WithBrightness(*brightness),
+		display.WithContrast(*contrast),
+		display.WithHighContrast(*hiContrast),
+		display.WithKeypadOverlay(*showKeypad),
+		display.WithKeyDebounce(*debounce),
+	}, hotkeys...)...)
 	if err != nil {
 		panic(err)
 	}
-	vm := &vm.VM{}
-	vm.Init(*display)
-	vm.LoadROM("roms/test_opcode.ch8")
-	vm.Run()
+	if recent := settings.RecentROMs(); *romPath == "" && *lastROM && len(recent) > 0 {
+		*romPath = recent[0]
+	}
+	if *romPath == "" && *loadPath == "" {
+		path, err := chooseROM(display)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			return nil
+		}
+		*romPath = path
+	}
+	chip8, cleanup, err := newVM(display, display)
+	if err != nil {
+		panic(err)
+	}
+	defer cleanup()
+	setROMName(chip8.ROMName())
+	go showSpeed(display, chip8)
+	go watchDrops(display, chip8)
+	return runVM(chip8)
+}
+
+// beeper returns the audio backend set by the flags, silent when headless
+func beeper() vm.AudioBeeper {
+	if *bell && !*noWindow {
+		return audio.NewBell(os.Stderr)
+	}
+	return audio.Silent{}
+}
+
+// wavFile writes the beeps recorded by recorder to File when closed
+type wavFile struct {
+	*os.File
+	recorder *audio.Recorder
+}
+
+func (f *wavFile) Close() error {
+	err := f.recorder.WriteWAV(f.File)
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("can't write %s: %v", f.Name(), err)
+	}
+	return err
+}
+
+// newVM creates a VM drawing to renderer and reading keys from input (which may be nil), with
+// the options and hooks set by the flags, and loads the ROM at -rom into it. Call the returned
+// cleanup function once finished with the VM
+func newVM(renderer vm.Renderer, input vm.Input) (chip8 *vm.VM, cleanup func(), err error) {
+	profile, err := romProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+	var closers []io.Closer
+	cleanup = func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+	fill, err := vm.ParseMemoryFill(*memFill)
+	if err != nil {
+		return nil, nil, err
+	}
+	chip8 = &vm.VM{}
+	chip8.Init(renderer, append(profile.Options(),
+		vm.WithPauseOnBlur(*pauseOnBlur),
+		vm.WithDrawThrottle(*throttle),
+		vm.WithStartDelayFrames(*startDelay),
+		vm.WithStartPaused(*debug),
+		vm.WithQuirkWarnings(*quirkWarn),
+		vm.WithInput(input),
+		vm.WithKeyRepeat(*keyRepeat),
+		vm.WithAudio(beeper()),
+		vm.WithMinSoundDuration(*minBeep),
+		vm.WithPanicRecovery(*recoverROM),
+		vm.WithFrameStats(*frameStats),
+		vm.WithStrictOpcodes(*strict),
+		vm.WithPauseOnUnimplemented(*pauseUnimpl),
+		vm.WithIgnoreUnknown00NN(*ignore00NN),
+		vm.WithIgnoreUnknownFXNN(*ignoreFXNN),
+		vm.WithProtectReservedMemory(protectOption()),
+		vm.WithMemoryFill(fill),
+		hiresOption(),
+	)...)
+	chip8.SetLogger(log.Default())
+	if *debug {
+		vm.WithHistory(debugHistory)(chip8)
+	}
+	if *logKeys {
+		vm.WithInputLog(os.Stderr)(chip8)
+	}
+	if *tracePath != "" {
+		f, err := os.Create(*tracePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, f)
+		vm.WithTrace(f)(chip8)
+	}
+	if *recordPath != "" {
+		f, err := os.Create(*recordPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		recorder := audio.NewRecorder(recordRate)
+		closers = append(closers, &wavFile{File: f, recorder: recorder})
+		vm.WithAudio(recorder)(chip8)
+		vm.WithAudioSamples(recordRate)(chip8)
+	}
+	if *ppmPath != "" {
+		f, err := os.Create(*ppmPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, f)
+		chip8.SetFrameHook(headless.NewPPMStreamRenderer(f, ppmScale).Render)
+	}
+	if *logSound {
+		chip8.SetSoundHook(func(active bool) {
+			if active {
+				log.Println("sound timer started")
+			} else {
+				log.Println("sound timer stopped")
+			}
+		})
+	}
+	if *logOverflow {
+		chip8.SetOverflowHook(func(x int, a, b uint8, pc uint16) {
+			log.Printf("overflow at %#04x: V%X = %d + %d", pc, x, a, b)
+		})
+	}
+	if *logBorrow {
+		chip8.SetBorrowHook(func(x int, a, b uint8, pc uint16) {
+			log.Printf("borrow at %#04x: V%X = %d - %d", pc, x, a, b)
+		})
+	}
+	if *dryDraw {
+		vm.WithDrawDryRun(logDraw)(chip8)
+	}
+	if err := addCheats(chip8, *cheats); err != nil {
+		return nil, nil, err
+	}
+	if *beepCollide {
+		// Ring the terminal bell rather than using the audio backend, which plays the ROM's own
+		// beep: the cue then can't be mistaken for the ROM's sound or cut short by it, and
+		// works without -bell
+		vm.WithBeepOnCollision(func() { fmt.Fprint(os.Stderr, "\a") })(chip8)
+	}
+	if *loadPath != "" {
+		if err := loadState(chip8, *loadPath); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if err := loadROM(chip8, *romPath); err != nil {
+			return nil, nil, err
+		}
+		if err := settings.AddRecentROM(*romPath); err != nil {
+			log.Printf("can't save recent ROMs: %v", err)
+		}
+	}
+	if *autoClock && !flagSet("clock") {
+		hz := chip8.SuggestedClockSpeed()
+		log.Printf("calibrated clock speed: %d Hz", hz)
+		vm.WithClockSpeed(hz)(chip8)
+	}
+	if *debug {
+		go debugConsole(chip8)
+	}
+	if *debugAddr != "" {
+		l, err := chip8.StartDebugServer(*debugAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, l)
+	}
+	return chip8, cleanup, nil
+}
+
+// runVM runs chip8 until its window is closed or the ROM stops, returning any error other than
+// the ROM exiting normally
+func runVM(chip8 *vm.VM) error {
+	err := chip8.Run()
+	if *frameStats {
+		printFrameStats(chip8.InstructionsPerFrameStats())
+	}
+	if err != nil && !errors.Is(err, vm.ErrHalt) {
+		return err
+	}
+	return nil
+}
+
+// printFrameStats prints the histogram of instructions executed per frame, in order of the
+// number of instructions
+func printFrameStats(stats map[int]int) {
+	counts := make([]int, 0, len(stats))
+	for n := range stats {
+		counts = append(counts, n)
+	}
+	sort.Ints(counts)
+	fmt.Println("instructions per frame: frames")
+	for _, n := range counts {
+		fmt.Printf("%d: %d\n", n, stats[n])
+	}
+}
+
+// romProfile returns the settings to run the ROM with: those saved for it (or the defaults),
+// overridden by any flags set explicitly. With -saveprofile the result is saved for next time
+func romProfile() (settings.Profile, error) {
+	name := filepath.Base(*romPath)
+	profile, ok := settings.LoadROMSettings(name)
+	if !ok {
+		profile = settings.DefaultProfile()
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "clock":
+			profile.ClockSpeed = *clockSpeed
+		case "cyclesperframe":
+			profile.CyclesPerFrame = *perFrame
+		case "drawcost":
+			profile.DrawCycleCost = *drawCost
+		case "xochip":
+			profile.XOChip = *xoChip
+		}
+	})
+	if *saveProfile {
+		return profile, settings.SaveROMSettings(name, profile)
+	}
+	return profile, nil
+}
+
+// flagSet reports whether the named flag was set on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// logDraw logs where a sprite would be drawn, for -drydraw
+func logDraw(e vm.DrawEvent) {
+	wrapped, clipped := 0, 0
+	for _, p := range e.Pixels {
+		if p.Wrapped {
+			wrapped++
+		}
+		if p.Clipped {
+			clipped++
+		}
+	}
+	log.Printf("draw at %#04x: (%d, %d), %d pixels, %d wrapped, %d clipped", e.PC, e.X, e.Y, len(e.Pixels), wrapped, clipped)
+}
+
+// hiresOption returns the HIRES mode option for the -hires flag
+func hiresOption() vm.Option {
+	if *hires {
+		return vm.WithHires(vm.HiresDetect)
+	}
+	return vm.WithHires(vm.HiresOff)
+}
+
+// protectOption returns the reserved memory protection for the -protectreserved flag
+func protectOption() vm.MemoryProtection {
+	if *protect {
+		return vm.ProtectError
+	}
+	return vm.ProtectOff
+}
+
+// addCheats adds the cheats in spec, a comma separated list of addr=value pairs
+func addCheats(chip8 *vm.VM, spec string) error {
+	if spec == "" {
+		return nil
+	}
+	for _, cheat := range strings.Split(spec, ",") {
+		parts := strings.SplitN(cheat, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad cheat %q, expected addr=value", cheat)
+		}
+		addr, err := strconv.ParseUint(parts[0], 0, 12)
+		if err != nil {
+			return fmt.Errorf("bad cheat address %q: %w", parts[0], err)
+		}
+		value, err := strconv.ParseUint(parts[1], 0, 8)
+		if err != nil {
+			return fmt.Errorf("bad cheat value %q: %w", parts[1], err)
+		}
+		chip8.AddCheat(uint16(addr), byte(value))
+	}
+	return nil
+}
+
+// How long a status message is shown in the window title
+const statusDuration = 5 * time.Second
+
+// What the window title shows besides the speed: the ROM running, and any recent status message
+var title struct {
+	sync.Mutex
+	rom         string
+	status      string
+	statusUntil time.Time
+}
+
+func setROMName(name string) {
+	title.Lock()
+	defer title.Unlock()
+	title.rom = name
+}
+
+// setStatus shows a message in the window title for a few seconds
+func setStatus(msg string) {
+	title.Lock()
+	defer title.Unlock()
+	title.status, title.statusUntil = msg, time.Now().Add(statusDuration)
+}
+
+// showSpeed periodically updates the window title with the ROM and the achieved emulation speed
+func showSpeed(display *display.Display, chip8 *vm.VM) {
+	for range time.Tick(time.Second) {
+		title.Lock()
+		text := fmt.Sprintf("Chip8 - %s - %.0f%% speed", title.rom, chip8.EmulationSpeed()*100)
+		if time.Now().Before(title.statusUntil) {
+			text = fmt.Sprintf("Chip8 - %s", title.status)
+		}
+		title.Unlock()
+		display.SetTitle(text)
+	}
+}
+
+// Key that saves the state to the -savestate file
+const saveStateKey = pixelgl.KeyF5
+
+// saveState saves the state of chip8 to the file at path
+func saveState(chip8 *vm.VM, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("can't save state: %v", err)
+		return
+	}
+	err = chip8.SaveState(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("can't save state: %v", err)
+		return
+	}
+	setStatus("state saved to " + filepath.Base(path))
+}
+
+// loadState restores chip8 to the state saved in the file at path
+func loadState(chip8 *vm.VM, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return chip8.LoadState(f)
+}
+
+// loadROM loads the ROM at path, which may be a file or an HTTP(S) URL
+func loadROM(chip8 *vm.VM, path string) error {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return chip8.LoadROMURL(path)
+	}
+	return chip8.LoadROM(path)
+}
+
+// verifyTrace replays the trace at -verifytrace against the ROM, without opening a window
+func verifyTrace() error {
+	profile, err := romProfile()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(*verifyPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chip8 := &vm.VM{}
+	chip8.Init(nil, append(profile.Options(), hiresOption())...)
+	if *logOverflow {
+		chip8.SetOverflowHook(func(x int, a, b uint8, pc uint16) {
+			log.Printf("overflow at %#04x: V%X = %d + %d", pc, x, a, b)
+		})
+	}
+	if *logBorrow {
+		chip8.SetBorrowHook(func(x int, a, b uint8, pc uint16) {
+			log.Printf("borrow at %#04x: V%X = %d - %d", pc, x, a, b)
+		})
+	}
+	if err := loadROM(chip8, *romPath); err != nil {
+		return err
+	}
+	return chip8.VerifyTrace(f)
+}
+
+// dumpDisassembly writes the disassembly of the ROM to the file at -disasm, without opening a
+// window
+func dumpDisassembly() error {
+	chip8 := &vm.VM{}
+	chip8.Init(nil)
+	if err := loadROM(chip8, *romPath); err != nil {
+		return err
+	}
+	f, err := os.Create(*disasmPath)
+	if err != nil {
+		return err
+	}
+	if err := chip8.DumpDisassembly(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func main() {
-	pixelgl.Run(test)
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run does what the flags ask, returning any error only once everything it opened (recordings,
+// traces, frame dumps) has been written and closed, as log.Fatal would skip deferred calls
+func run() error {
+	if *listRecent {
+		for _, path := range settings.RecentROMs() {
+			fmt.Println(path)
+		}
+		return nil
+	}
+	if *verifyPath != "" {
+		if err := verifyTrace(); err != nil {
+			return err
+		}
+		fmt.Println("trace verified")
+		return nil
+	}
+	if *disasmPath != "" {
+		return dumpDisassembly()
+	}
+	if *noWindow {
+		return runHeadless()
+	}
+	var err error
+	pixelgl.Run(func() {
+		err = test()
+	})
+	return err
 }
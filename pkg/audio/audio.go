@@ -0,0 +1,48 @@
+package audio
+
+import (
+	"io"
+	"sync"
+)
+
+// TODO: Play a real tone, e.g. with https://github.com/hajimehoshi/oto
+
+// Bell is the default audio backend, ringing the terminal bell each time a beep starts. It can't
+// play a tone or its frequency, so a beep is as long as the terminal's bell. It implements
+// vm.AudioBeeper
+type Bell struct {
+	mu      sync.Mutex
+	w       io.Writer
+	playing bool
+}
+
+// NewBell returns a Bell that rings by writing the BEL character to w, usually os.Stderr
+func NewBell(w io.Writer) *Bell {
+	return &Bell{w: w}
+}
+
+// Start rings the bell, unless a beep is already playing
+func (b *Bell) Start(freq float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.playing {
+		return
+	}
+	b.playing = true
+	b.w.Write([]byte{'\a'})
+}
+
+// Stop ends the beep, so the next Start rings again
+func (b *Bell) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.playing = false
+}
+
+// Silent is an audio backend that plays nothing, for tests and headless runs. It implements
+// vm.AudioBeeper
+type Silent struct{}
+
+func (Silent) Start(freq float64) {}
+
+func (Silent) Stop() {}
@@ -0,0 +1,40 @@
+package audio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBell(t *testing.T) {
+	var out bytes.Buffer
+	b := NewBell(&out)
+	b.Start(440)
+	b.Start(440)
+	if out.String() != "\a" {
+		t.Errorf("expected one bell while playing, got %q", out.String())
+	}
+	b.Stop()
+	b.Start(440)
+	if out.String() != "\a\a" {
+		t.Errorf("expected a second bell after stopping, got %q", out.String())
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(8000)
+	r.PlaySamples([]float32{1, -1})
+	r.PlaySamples([]float32{0})
+	var out bytes.Buffer
+	if err := r.WriteWAV(&out); err != nil {
+		t.Fatal(err)
+	}
+	wav := out.Bytes()
+	if len(wav) != 44+6 || string(wav[:4]) != "RIFF" || string(wav[36:40]) != "data" {
+		t.Fatalf("expected a 44 byte header and 3 samples, got % x", wav)
+	}
+	// The samples, as little endian 16 bit integers
+	want := []byte{0xFF, 0x7F, 0x01, 0x80, 0x00, 0x00}
+	if !bytes.Equal(wav[44:], want) {
+		t.Errorf("expected samples % x, got % x", want, wav[44:])
+	}
+}
@@ -0,0 +1,57 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Recorder keeps the samples of every beep, to be written out as a WAV file. It implements
+// vm.AudioBeeper and vm.AudioSampler, so the VM must generate samples at the same rate, see
+// vm.WithAudioSamples. Silence between beeps isn't recorded
+type Recorder struct {
+	mu      sync.Mutex
+	rate    int
+	samples []float32
+}
+
+// NewRecorder returns a Recorder of samples at rate per second
+func NewRecorder(rate int) *Recorder {
+	return &Recorder{rate: rate}
+}
+
+func (r *Recorder) Start(freq float64) {}
+
+func (r *Recorder) Stop() {}
+
+// PlaySamples records samples
+func (r *Recorder) PlaySamples(samples []float32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, samples...)
+}
+
+// WriteWAV writes the samples recorded so far to w as a mono, 16 bit PCM WAV file
+func (r *Recorder) WriteWAV(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	const bytesPerSample = 2
+	size := uint32(len(r.samples) * bytesPerSample)
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + size, [4]byte{'W', 'A', 'V', 'E'},
+		// Format chunk: PCM, 1 channel, the sample and byte rates, block size and bits per sample
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(r.rate), uint32(r.rate * bytesPerSample), uint16(bytesPerSample), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, size,
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	data := make([]int16, len(r.samples))
+	for i, s := range r.samples {
+		data[i] = int16(s * 32767)
+	}
+	return binary.Write(w, binary.LittleEndian, data)
+}
@@ -0,0 +1,89 @@
+package display
+
+import (
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// Render draws the screen into a canvas at the CHIP-8 resolution, which is then drawn scaled to
+// fit the window, so resizing only changes the transform it's drawn with. Each CHIP-8 pixel is
+// subRows canvas pixels tall, so that scanlines can be drawn across the bottom half of each row
+const subRows = 2
+
+// screenCanvas holds the canvas and the state it was drawn from. It's only redrawn when the
+// pixels change. The standard screen uses the top 32 rows of the buffer, HIRES mode all 64
+type screenCanvas struct {
+	canvas *pixelgl.Canvas
+	pixels [64][64]byte
+	// Number of rows of the screen in use, 32 or 64
+	rows  int
+	valid bool
+	// Mirror the image, see WithFlipX and WithFlipY
+	flipX, flipY bool
+	// How much to darken the bottom half of each row, see WithScanlines
+	scanlines float64
+	// Colour of each canvas pixel, as RGBA bytes from the bottom left, row by row
+	rgba []uint8
+}
+
+// update redraws the canvas from the top rows of pixels if they've changed since it was last drawn
+func (c *screenCanvas) update(pixels [64][64]byte, rows int, colors [4]pixel.RGBA) {
+	if c.valid && rows == c.rows && pixels == c.pixels {
+		return
+	}
+	c.pixels, c.rows, c.valid = pixels, rows, true
+	c.paint(colors)
+	bounds := pixel.R(0, 0, width, float64(rows*subRows))
+	if c.canvas == nil {
+		c.canvas = pixelgl.NewCanvas(bounds)
+	} else if c.canvas.Bounds() != bounds {
+		c.canvas.SetBounds(bounds)
+	}
+	c.canvas.SetPixels(c.rgba)
+}
+
+// paint fills rgba with the colour of each canvas pixel
+func (c *screenCanvas) paint(colors [4]pixel.RGBA) {
+	c.rgba = make([]uint8, 4*int(width)*c.rows*subRows)
+	for x := 0; x < int(width); x++ {
+		for y := 0; y < c.rows; y++ {
+			color := colors[c.pixels[x][y]&0x3]
+			col, row := c.position(x, y)
+			for sub := 0; sub < subRows; sub++ {
+				k := 1.0
+				if sub < subRows/2 && c.pixels[x][y] != 0 {
+					// Darken the bottom half of lit pixels
+					k -= c.scanlines
+				}
+				i := 4 * ((int(row)*subRows+sub)*int(width) + int(col))
+				c.rgba[i] = uint8(color.R * k * 255)
+				c.rgba[i+1] = uint8(color.G * k * 255)
+				c.rgba[i+2] = uint8(color.B * k * 255)
+				c.rgba[i+3] = 255
+			}
+		}
+	}
+}
+
+// position returns the column and row of the window, counted in CHIP-8 pixels from the bottom
+// left, that the buffer's pixel (x, y) is drawn at
+func (c *screenCanvas) position(x, y int) (col, row float64) {
+	col, row = float64(x), float64(y)
+	if c.flipX {
+		col = 63 - col
+	}
+	// The buffer's y runs from the top down, the window's from the bottom up, so it's flipped
+	// unless asked to be
+	if !c.flipY {
+		row = float64(c.rows-1) - row
+	}
+	return col, row
+}
+
+// draw draws the canvas onto t, each CHIP-8 pixel size screen pixels square, with its bottom left
+// corner at origin
+func (c *screenCanvas) draw(t pixel.Target, size float64, origin pixel.Vec) {
+	// The canvas is drawn centred on the matrix's origin
+	center := origin.Add(pixel.V(width*size/2, float64(c.rows)*size/2))
+	c.canvas.Draw(t, pixel.IM.ScaledXY(pixel.ZV, pixel.V(size, size/subRows)).Moved(center))
+}
@@ -1,10 +1,11 @@
 package display
 
 import (
-	"image/color"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/faiface/pixel"
-	"github.com/faiface/pixel/imdraw"
 
 	"github.com/faiface/pixel/pixelgl"
 )
@@ -28,6 +29,23 @@ var FontSet = [80]byte{
 	0xF0, 0x80, 0xF0, 0x80, 0x80, // F
 }
 
+// Colours for each combination of XO-CHIP planes a pixel can be lit in: neither, plane 1 only,
+// plane 2 only and both. Without XO-CHIP only plane 1 is used, so pixels are black or white
+var palette = [4]pixel.RGBA{
+	pixel.RGB(0, 0, 0),
+	pixel.RGB(1, 1, 1),
+	pixel.RGB(1, 0.4, 0),
+	pixel.RGB(0.4, 0.13, 0),
+}
+
+// High contrast alternative to palette, see WithHighContrast
+var highContrastPalette = [4]pixel.RGBA{
+	pixel.RGB(0, 0, 0),
+	pixel.RGB(1, 1, 1),
+	pixel.RGB(1, 1, 0),
+	pixel.RGB(0, 1, 1),
+}
+
 const (
 	width     float64 = 64
 	height    float64 = 32
@@ -36,39 +54,214 @@ const (
 
 type Display struct {
 	*pixelgl.Window
+	// Synchronise frames with the monitor's refresh rate
+	vsync bool
+	// Maximum frames per second when VSync is disabled, enforced by frameTicker
+	maxFPS      int
+	frameTicker *time.Ticker
+	// Scale by whole numbers only, so every pixel is the same size
+	integerScaling bool
+	// Mirror the image horizontally and/or vertically, e.g. for a cabinet viewed through a mirror
+	flipX, flipY bool
+	// How much (0-1) to darken the scanlines of a CRT effect, 0 for none
+	scanlines float64
+	// Colours pixels are drawn in, the palette adjusted for brightness and contrast
+	colors       [4]pixel.RGBA
+	highContrast bool
+	brightness   float64
+	contrast     float64
+	// Debounced state of the keypad and when each key last changed, see WithKeyDebounce
+	keys       [16]bool
+	keyChanged [16]time.Time
+	debounce   time.Duration
+	// Keys outside the keypad handled by the display itself
+	hotkeys []*hotkey
+	// The screen drawn by Render, redrawn only when the pixels change
+	screen screenCanvas
+	// Whether to draw the keypad below the screen, see WithKeypadOverlay
+	showKeypad bool
+	keypad     keypadCanvas
+	// Paths of files dropped onto the window, waiting to be collected by Dropped
+	dropMu  sync.Mutex
+	dropped []string
+}
+
+// Option configures optional behaviour of the display, passed to NewDisplay
+type Option func(*Display)
+
+// WithVSync enables (the default) or disables VSync. With VSync disabled the frame rate is
+// instead capped by WithMaxFPS
+func WithVSync(enabled bool) Option {
+	return func(d *Display) {
+		d.vsync = enabled
+	}
+}
+
+// WithMaxFPS sets the maximum frame rate when VSync is disabled, 60 by default. Pass 0 for no cap
+func WithMaxFPS(fps int) Option {
+	return func(d *Display) {
+		d.maxFPS = fps
+	}
+}
+
+// WithIntegerScaling scales the image by the largest whole number that fits the window, rather
+// than filling it, so that every CHIP-8 pixel is exactly the same number of screen pixels
+func WithIntegerScaling(enabled bool) Option {
+	return func(d *Display) {
+		d.integerScaling = enabled
+	}
+}
+
+// WithFlipX mirrors the image horizontally, so the buffer's x = 0 column is drawn on the right
+func WithFlipX(enabled bool) Option {
+	return func(d *Display) {
+		d.flipX = enabled
+	}
+}
+
+// WithFlipY mirrors the image vertically, so the buffer's y = 0 row is drawn at the bottom
+func WithFlipY(enabled bool) Option {
+	return func(d *Display) {
+		d.flipY = enabled
+	}
+}
+
+// WithScanlines draws the image with the scanlines of an old CRT, by darkening the bottom half
+// of each row of pixels. intensity (0 to 1) is how much darker the scanlines are, 0 (the
+// default) to disable them
+func WithScanlines(intensity float64) Option {
+	return func(d *Display) {
+		d.scanlines = math.Max(0, math.Min(1, intensity))
+	}
+}
+
+// WithBrightness adds b (-1 to 1) to each colour component, brightening (or darkening if negative)
+// the whole image. 0 by default
+func WithBrightness(b float64) Option {
+	return func(d *Display) {
+		d.brightness = b
+	}
+}
+
+// WithContrast scales each colour component's distance from mid-grey by c, so values above 1
+// increase the contrast and values below 1 reduce it. 1 by default
+func WithContrast(c float64) Option {
+	return func(d *Display) {
+		d.contrast = c
+	}
+}
+
+// WithHighContrast draws in a high contrast palette of white, yellow and cyan on black, for users
+// who find the default colours hard to tell apart. Brightness and contrast still apply
+func WithHighContrast(enabled bool) Option {
+	return func(d *Display) {
+		d.highContrast = enabled
+	}
+}
+
+// adjustColors sets the colours to draw in from the palette, brightness and contrast
+func (d *Display) adjustColors() {
+	base := palette
+	if d.highContrast {
+		base = highContrastPalette
+	}
+	adjust := func(c float64) float64 {
+		return math.Max(0, math.Min(1, (c-0.5)*d.contrast+0.5+d.brightness))
+	}
+	for i, c := range base {
+		d.colors[i] = pixel.RGB(adjust(c.R), adjust(c.G), adjust(c.B))
+	}
 }
 
-func NewDisplay() (*Display, error) {
+func NewDisplay(opts ...Option) (*Display, error) {
+	d := &Display{
+		vsync:    true,
+		maxFPS:   60,
+		contrast: 1,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.adjustColors()
+	d.screen.flipX, d.screen.flipY = d.flipX, d.flipY
+	d.screen.scanlines = d.scanlines
+
+	h := height
+	if d.showKeypad {
+		h += keypadArea
+	}
 	cfg := pixelgl.WindowConfig{
-		Title:  "Chip8",
-		Bounds: pixel.R(0, 0, width*pixelSize, height*pixelSize),
-		VSync:  true,
+		Title:     "Chip8",
+		Bounds:    pixel.R(0, 0, width*pixelSize, h*pixelSize),
+		VSync:     d.vsync,
+		Resizable: true,
 	}
 	win, err := pixelgl.NewWindow(cfg)
 	if err != nil {
 		panic(err)
 	}
-	return &Display{
-		win,
-	}, nil
+	d.Window = win
+	d.handleDrops()
+	if !d.vsync && d.maxFPS > 0 {
+		d.frameTicker = time.NewTicker(time.Second / time.Duration(d.maxFPS))
+	}
+	return d, nil
 }
 
+// Render draws the standard 64x32 screen
 func (d *Display) Render(pixels [64][32]byte) {
-	d.Clear(color.Black)
-	imd := imdraw.New(nil)
-	imd.Color = pixel.RGB(1, 1, 1)
-
-	// Draw pixels from top left -> bottom right
-	for x := 0; x < int(width); x++ {
-		for y := 0; y < int(height); y++ {
-			if pixels[x][31-y] != 0 {
-				imd.Push(pixel.V(pixelSize*float64(x), pixelSize*float64(y)))
-				imd.Push(pixel.V(pixelSize*float64(x)+pixelSize, pixelSize*float64(y)+pixelSize))
-				imd.Rectangle(0)
-			}
-		}
-	}
-
-	imd.Draw(d)
+	var full [64][64]byte
+	for x := range pixels {
+		copy(full[x][:], pixels[x][:])
+	}
+	d.render(full, 32)
+}
+
+// RenderHires draws the 64x64 screen of the HIRES mode
+func (d *Display) RenderHires(pixels [64][64]byte) {
+	d.render(pixels, 64)
+}
+
+// render draws the top rows of pixels
+func (d *Display) render(pixels [64][64]byte, rows int) {
+	d.updateKeys()
+	d.screen.update(pixels, rows, d.colors)
+	d.draw()
+}
+
+// draw draws the screen as last rendered, and the keypad if shown, then waits for the next frame
+func (d *Display) draw() {
+	d.Clear(d.colors[0])
+	rows := d.screen.rows
+
+	// Scale to the current window size, preserving the aspect ratio (2:1, or 1:1 in HIRES mode,
+	// plus the keypad if shown). Any leftover space is split evenly either side of the image
+	// (letterboxing) and left as the background colour
+	bounds := d.Bounds()
+	h := float64(rows)
+	if d.showKeypad {
+		h += keypadArea
+	}
+	size := math.Min(bounds.W()/width, bounds.H()/h)
+	if d.integerScaling && size >= 1 {
+		size = math.Floor(size)
+	}
+	origin := pixel.V((bounds.W()-width*size)/2, (bounds.H()-h*size)/2)
+	if d.integerScaling {
+		// Keep pixel edges on screen pixel boundaries too
+		origin = pixel.V(math.Floor(origin.X), math.Floor(origin.Y))
+	}
+
+	if d.showKeypad {
+		// The keypad goes in the bottom of the image, below the screen
+		d.keypad.update(d.keys, d.colors)
+		d.keypad.draw(d, size, origin.Add(pixel.V(width*size/2, keypadArea*size/2)))
+		origin.Y += keypadArea * size
+	}
+	d.screen.draw(d, size, origin)
+	if d.frameTicker != nil {
+		// Without VSync to limit us, wait for the next frame
+		<-d.frameTicker.C
+	}
 	d.Update()
 }
@@ -1 +1,81 @@
 package display
+
+import "testing"
+
+func TestPosition(t *testing.T) {
+	tests := []struct {
+		flipX, flipY bool
+		rows         int
+		x, y         int
+		col, row     float64
+	}{
+		{false, false, 32, 0, 0, 0, 31},
+		{false, false, 32, 63, 31, 63, 0},
+		{true, false, 32, 0, 0, 63, 31},
+		{false, true, 32, 0, 0, 0, 0},
+		{true, true, 32, 10, 5, 53, 5},
+		{false, false, 64, 0, 0, 0, 63},
+		{false, true, 64, 0, 40, 0, 40},
+	}
+	for _, tc := range tests {
+		c := screenCanvas{rows: tc.rows, flipX: tc.flipX, flipY: tc.flipY}
+		col, row := c.position(tc.x, tc.y)
+		if col != tc.col || row != tc.row {
+			t.Errorf("flipX=%v flipY=%v rows=%d: position(%d, %d) = (%v, %v), want (%v, %v)",
+				tc.flipX, tc.flipY, tc.rows, tc.x, tc.y, col, row, tc.col, tc.row)
+		}
+	}
+}
+
+func TestPaint(t *testing.T) {
+	c := screenCanvas{rows: 32, scanlines: 0.5}
+	c.pixels[0][0] = 1
+	c.paint(palette)
+	if len(c.rgba) != 4*64*32*subRows {
+		t.Fatalf("expected %d bytes, got %d", 4*64*32*subRows, len(c.rgba))
+	}
+	// The top left pixel is the top two canvas rows, the bottom one darkened by the scanline
+	top := 4 * (63 * 64)
+	bottom := 4 * (62 * 64)
+	if c.rgba[top] != 255 || c.rgba[top+3] != 255 {
+		t.Errorf("expected the top half of the pixel to be white, got %v", c.rgba[top:top+4])
+	}
+	if c.rgba[bottom] != 127 {
+		t.Errorf("expected the bottom half of the pixel to be darkened, got %v", c.rgba[bottom:bottom+4])
+	}
+	if c.rgba[top+4] != 0 || c.rgba[top+7] != 255 {
+		t.Errorf("expected the next pixel to be opaque black, got %v", c.rgba[top+4:top+8])
+	}
+}
+
+func TestPaintKeypad(t *testing.T) {
+	var c keypadCanvas
+	c.keys[0x5] = true
+	c.paint(palette)
+	w, h := 4*keyWidth, 4*keyHeight
+	if len(c.rgba) != 4*w*h {
+		t.Fatalf("expected %d bytes, got %d", 4*w*h, len(c.rgba))
+	}
+	// at returns the red component of the canvas pixel (x, y), counted from the top left
+	at := func(x, y int) uint8 {
+		return c.rgba[4*((h-1-y)*w+x)]
+	}
+	// Key 1, at the top left, isn't held: its border is dim, and the top of its digit lit
+	if got := at(0, 0); got != 63 {
+		t.Errorf("expected key 1's background to be dim, got %d", got)
+	}
+	if got := at(3, 1); got != 255 {
+		t.Errorf("expected key 1's digit to be lit, got %d", got)
+	}
+	// Key 5, in the middle of the second row, is held, so it's inverted
+	if got := at(keyWidth, keyHeight); got != 255 {
+		t.Errorf("expected key 5's background to be lit, got %d", got)
+	}
+	if got := at(keyWidth+1, keyHeight+1); got != 0 {
+		t.Errorf("expected key 5's digit to be dark, got %d", got)
+	}
+	// The gap between keys is the background colour
+	if got := at(keyWidth-1, 0); got != 0 {
+		t.Errorf("expected a gap between keys, got %d", got)
+	}
+}
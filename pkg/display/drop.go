@@ -0,0 +1,33 @@
+package display
+
+import (
+	"github.com/faiface/mainthread"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// handleDrops records files dropped onto the window, to be collected with Dropped. pixelgl doesn't
+// expose the drop callback, but its window's context is current on the main thread after
+// pixelgl.NewWindow, so the underlying GLFW window can be found from there
+func (d *Display) handleDrops() {
+	mainthread.Call(func() {
+		win := glfw.GetCurrentContext()
+		if win == nil {
+			return
+		}
+		win.SetDropCallback(func(_ *glfw.Window, names []string) {
+			d.dropMu.Lock()
+			defer d.dropMu.Unlock()
+			d.dropped = append(d.dropped, names...)
+		})
+	})
+}
+
+// Dropped returns the paths of any files dropped onto the window since it was last called. Drops
+// are only noticed while the window is processing events, e.g. during Render
+func (d *Display) Dropped() []string {
+	d.dropMu.Lock()
+	defer d.dropMu.Unlock()
+	names := d.dropped
+	d.dropped = nil
+	return names
+}
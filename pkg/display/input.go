@@ -0,0 +1,90 @@
+package display
+
+import (
+	"time"
+
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// Keys maps each key of the hex keypad to a key on the keyboard, using the usual layout of the
+// left hand side of a QWERTY keyboard:
+//
+//	1 2 3 C      1 2 3 4
+//	4 5 6 D  ->  Q W E R
+//	7 8 9 E      A S D F
+//	A 0 B F      Z X C V
+var Keys = [16]pixelgl.Button{
+	pixelgl.KeyX,
+	pixelgl.Key1, pixelgl.Key2, pixelgl.Key3,
+	pixelgl.KeyQ, pixelgl.KeyW, pixelgl.KeyE,
+	pixelgl.KeyA, pixelgl.KeyS, pixelgl.KeyD,
+	pixelgl.KeyZ, pixelgl.KeyC,
+	pixelgl.Key4, pixelgl.KeyR, pixelgl.KeyF, pixelgl.KeyV,
+}
+
+// WithKeyDebounce ignores a key changing state within interval of its last change, filtering out
+// spurious presses and releases. Off (0) by default
+func WithKeyDebounce(interval time.Duration) Option {
+	return func(d *Display) {
+		d.debounce = interval
+	}
+}
+
+// hotkey is a key outside the keypad that runs a function when pressed, see WithHotkey
+type hotkey struct {
+	button pixelgl.Button
+	fn     func()
+	// Whether the key was held when last checked, so fn runs once per press
+	down bool
+}
+
+// WithHotkey runs fn each time button is pressed, e.g. to toggle a debugging aid at runtime
+// without restarting. The key is handled by the display and never reaches the keypad, so it
+// should be one that isn't mapped in Keys. fn is called from the emulation loop, so it mustn't
+// block
+func WithHotkey(button pixelgl.Button, fn func()) Option {
+	return func(d *Display) {
+		d.hotkeys = append(d.hotkeys, &hotkey{button: button, fn: fn})
+	}
+}
+
+// checkHotkeys runs the function of each hotkey pressed since it was last checked
+func (d *Display) checkHotkeys() {
+	for _, h := range d.hotkeys {
+		pressed := d.Pressed(h.button)
+		if pressed && !h.down {
+			h.fn()
+		}
+		h.down = pressed
+	}
+}
+
+// UpdateInput polls for window events while nothing is being rendered, e.g. while the VM is
+// paused or the ROM isn't drawing, so that hotkeys still work and the keypad overlay still shows
+// the keys held
+func (d *Display) UpdateInput() {
+	d.Window.UpdateInput()
+	d.updateKeys()
+	if d.showKeypad && d.screen.valid && d.keys != d.keypad.keys {
+		d.draw()
+	}
+}
+
+// updateKeys updates the debounced state of the keypad from the keyboard, and handles hotkeys
+func (d *Display) updateKeys() {
+	d.checkHotkeys()
+	now := time.Now()
+	for key, button := range Keys {
+		pressed := d.Pressed(button)
+		if pressed != d.keys[key] && now.Sub(d.keyChanged[key]) >= d.debounce {
+			d.keys[key] = pressed
+			d.keyChanged[key] = now
+		}
+	}
+}
+
+// IsPressed reports whether the keyboard key mapped to key is held down
+func (d *Display) IsPressed(key byte) bool {
+	d.updateKeys()
+	return d.keys[key&0xF]
+}
@@ -0,0 +1,110 @@
+package display
+
+import (
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/pixelgl"
+)
+
+// keypadLayout is the arrangement of the COSMAC VIP's hex keypad, as drawn by the overlay
+var keypadLayout = [4][4]byte{
+	{0x1, 0x2, 0x3, 0xC},
+	{0x4, 0x5, 0x6, 0xD},
+	{0x7, 0x8, 0x9, 0xE},
+	{0xA, 0x0, 0xB, 0xF},
+}
+
+const (
+	// Size in canvas pixels of each key, its digit from FontSet with a 1 pixel border, and a 1
+	// pixel gap to the next key
+	keyWidth  = 7
+	keyHeight = 8
+	// Size of a canvas pixel of the keypad, in CHIP-8 pixels
+	keypadTexel float64 = 0.5
+	// Height in CHIP-8 pixels of the area below the screen the keypad is drawn in, including a
+	// margin above and below it
+	keypadArea float64 = 4*keyHeight*keypadTexel + 2
+)
+
+// WithKeypadOverlay draws the hex keypad below the screen, showing which keys are held, e.g. for
+// streaming or teaching. The window is made taller to fit it. The keys held are updated every
+// frame, whether or not the ROM draws
+func WithKeypadOverlay(enabled bool) Option {
+	return func(d *Display) {
+		d.showKeypad = enabled
+	}
+}
+
+// keypadCanvas holds the canvas the keypad overlay is drawn into, and the keys it was drawn with.
+// Like screenCanvas, it's only redrawn when they change
+type keypadCanvas struct {
+	canvas *pixelgl.Canvas
+	keys   [16]bool
+	valid  bool
+	// Colour of each canvas pixel, as RGBA bytes from the bottom left, row by row
+	rgba []uint8
+}
+
+// update redraws the canvas if the held keys have changed since it was last drawn
+func (c *keypadCanvas) update(keys [16]bool, colors [4]pixel.RGBA) {
+	if c.valid && keys == c.keys {
+		return
+	}
+	c.keys, c.valid = keys, true
+	c.paint(colors)
+	if c.canvas == nil {
+		c.canvas = pixelgl.NewCanvas(pixel.R(0, 0, 4*keyWidth, 4*keyHeight))
+	}
+	c.canvas.SetPixels(c.rgba)
+}
+
+// paint fills rgba with the keypad: each key's digit lit on a dim background, inverted while
+// the key is held
+func (c *keypadCanvas) paint(colors [4]pixel.RGBA) {
+	const w, h = 4 * keyWidth, 4 * keyHeight
+	c.rgba = make([]uint8, 4*w*h)
+	set := func(x, y int, color pixel.RGBA) {
+		// Canvas rows run from the bottom up
+		i := 4 * ((h-1-y)*w + x)
+		c.rgba[i] = uint8(color.R * 255)
+		c.rgba[i+1] = uint8(color.G * 255)
+		c.rgba[i+2] = uint8(color.B * 255)
+		c.rgba[i+3] = 255
+	}
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			set(x, y, colors[0])
+		}
+	}
+	dim := colors[1].Scaled(0.25)
+	dim.A = 1
+	for row, keys := range keypadLayout {
+		for col, key := range keys {
+			bg, fg := dim, colors[1]
+			if c.keys[key] {
+				bg, fg = colors[1], colors[0]
+			}
+			left, top := col*keyWidth, row*keyHeight
+			for x := 0; x < keyWidth-1; x++ {
+				for y := 0; y < keyHeight-1; y++ {
+					color := bg
+					gx, gy := x-1, y-1
+					if gx >= 0 && gx < 4 && gy >= 0 && gy < 5 && spriteBit(FontSet[int(key)*5+gy], gx) {
+						color = fg
+					}
+					set(left+x, top+y, color)
+				}
+			}
+		}
+	}
+}
+
+// spriteBit reports whether bit x (0 is the leftmost) of a row of a sprite is set
+func spriteBit(b byte, x int) bool {
+	return b&(0x80>>x) != 0
+}
+
+// draw draws the canvas onto t, each of its pixels size*keypadTexel screen pixels square,
+// centred on center
+func (c *keypadCanvas) draw(t pixel.Target, size float64, center pixel.Vec) {
+	c.canvas.Draw(t, pixel.IM.Scaled(pixel.ZV, size*keypadTexel).Moved(center))
+}
@@ -0,0 +1,75 @@
+package headless
+
+import (
+	"image"
+	"image/color"
+	"strings"
+)
+
+const (
+	width  = 64
+	height = 32
+)
+
+// Renderer keeps the most recently rendered frame in memory rather than drawing it to a window
+type Renderer struct {
+	// The last frame passed to Render
+	Frame [64][32]byte
+	// The last frame passed to RenderHires, and whether it was more recent than Frame
+	HiresFrame [64][64]byte
+	Hires      bool
+	// Number of times Render or RenderHires has been called
+	Frames int
+}
+
+func (r *Renderer) Render(pixels [64][32]byte) {
+	r.Frame = pixels
+	r.Hires = false
+	r.Frames++
+}
+
+// RenderHires keeps a frame of the 64x64 HIRES mode
+func (r *Renderer) RenderHires(pixels [64][64]byte) {
+	r.HiresFrame = pixels
+	r.Hires = true
+	r.Frames++
+}
+
+// Text formats pixels as one line per row, using '#' for pixels that are on and '.' for off
+func Text(pixels [64][32]byte) string {
+	return text(func(x, y int) bool { return pixels[x][y] != 0 }, height)
+}
+
+// HiresText formats a 64x64 HIRES frame like Text
+func HiresText(pixels [64][64]byte) string {
+	return text(func(x, y int) bool { return pixels[x][y] != 0 }, 2*height)
+}
+
+// text formats the given number of rows of a frame, in which lit reports whether a pixel is on
+func text(lit func(x, y int) bool, rows int) string {
+	var sb strings.Builder
+	for y := 0; y < rows; y++ {
+		for x := 0; x < width; x++ {
+			if lit(x, y) {
+				sb.WriteByte('#')
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Image converts pixels to a black and white image, with each pixel scaled to scale x scale
+func Image(pixels [64][32]byte, scale int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width*scale, height*scale))
+	for x := 0; x < width*scale; x++ {
+		for y := 0; y < height*scale; y++ {
+			if pixels[x/scale][y/scale] != 0 {
+				img.SetGray(x, y, color.Gray{Y: 0xFF})
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,74 @@
+package headless
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/JoshCooperr/chip8/pkg/vm"
+)
+
+func TestRunROM(t *testing.T) {
+	// Draw the font sprite for 0 at (0, 0), then loop forever
+	rom := []byte{0xA2, 0x06, 0xD0, 0x05, 0x12, 0x04, 0xF0, 0x90, 0x90, 0x90, 0xF0}
+	r, err := RunROM(rom, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Frame[0][0] != 1 || r.Frame[1][1] != 0 {
+		t.Errorf("expected a 0 to be drawn, got\n%s", Text(r.Frame))
+	}
+
+	// The same, in HIRES mode at (0, 40)
+	rom = []byte{0xA2, 0x08, 0x61, 0x28, 0xD0, 0x15, 0x12, 0x06, 0xF0, 0x90, 0x90, 0x90, 0xF0}
+	r, err = RunROM(rom, 100, vm.WithHires(vm.HiresOn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Hires || r.HiresFrame[0][40] != 1 {
+		t.Error("expected a 0 to be drawn at (0, 40) in HIRES mode")
+	}
+
+	if _, err := RunROM([]byte{0x00, 0xEE}, 100); !errors.Is(err, vm.ErrStackUnderflow) {
+		t.Errorf("expected a stack underflow, got %v", err)
+	}
+}
+
+func TestPPMStreamRenderer(t *testing.T) {
+	var out bytes.Buffer
+	r := NewPPMStreamRenderer(&out, 2)
+	var pixels [64][32]byte
+	pixels[1][0] = 1
+	r.Render(pixels)
+	r.Render([64][32]byte{})
+	header := "P6\n128 64\n255\n"
+	frame := len(header) + 128*64*3
+	if out.Len() != 2*frame || !bytes.HasPrefix(out.Bytes(), []byte(header)) {
+		t.Fatalf("expected two %d byte frames, got %d bytes", frame, out.Len())
+	}
+	// Pixel (1, 0) covers (2, 0) to (3, 1) at scale 2
+	img := out.Bytes()[len(header):frame]
+	for _, p := range []struct {
+		x, y int
+		lit  bool
+	}{{1, 0, false}, {2, 0, true}, {3, 1, true}, {4, 0, false}} {
+		if lit := img[(p.y*128+p.x)*3] == 0xFF; lit != p.lit {
+			t.Errorf("expected (%d, %d) lit = %v", p.x, p.y, p.lit)
+		}
+	}
+}
+
+// FuzzExecute runs arbitrary bytes as a ROM, which must never panic
+func FuzzExecute(f *testing.F) {
+	for _, name := range []string{"IBM_Logo", "test_opcode", "chip8_picture"} {
+		if rom, err := os.ReadFile("../../roms/" + name + ".ch8"); err == nil {
+			f.Add(rom, false)
+		}
+	}
+	f.Add([]byte{0x22, 0x00}, false)
+	f.Add([]byte{0xAF, 0xFF, 0xDF, 0xFF}, true)
+	f.Fuzz(func(t *testing.T, rom []byte, xoChip bool) {
+		RunROM(rom, 1000, vm.WithXOChip(xoChip))
+	})
+}
@@ -0,0 +1,54 @@
+package headless
+
+import (
+	"fmt"
+	"io"
+)
+
+// PPMStreamRenderer writes each frame to a stream as a binary (P6) PPM image, white on black,
+// e.g. for ffmpeg to encode as a video with -f image2pipe -c:v ppm. Frames are written as they're
+// rendered, which isn't at a fixed rate unless the VM is throttled to 60Hz
+type PPMStreamRenderer struct {
+	w     io.Writer
+	scale int
+	buf   []byte
+	// The first error writing a frame. Once set, no more frames are written
+	Err error
+}
+
+// NewPPMStreamRenderer returns a renderer that writes frames to w, with each pixel scaled to
+// scale x scale
+func NewPPMStreamRenderer(w io.Writer, scale int) *PPMStreamRenderer {
+	if scale < 1 {
+		scale = 1
+	}
+	return &PPMStreamRenderer{w: w, scale: scale}
+}
+
+func (r *PPMStreamRenderer) Render(pixels [64][32]byte) {
+	r.write(func(x, y int) bool { return pixels[x][y] != 0 }, height)
+}
+
+// RenderHires writes a frame of the 64x64 HIRES mode, twice the height of the others
+func (r *PPMStreamRenderer) RenderHires(pixels [64][64]byte) {
+	r.write(func(x, y int) bool { return pixels[x][y] != 0 }, 2*height)
+}
+
+// write writes the given number of rows of a frame, in which lit reports whether a pixel is on
+func (r *PPMStreamRenderer) write(lit func(x, y int) bool, rows int) {
+	if r.Err != nil {
+		return
+	}
+	w, h := width*r.scale, rows*r.scale
+	r.buf = append(r.buf[:0], fmt.Sprintf("P6\n%d %d\n255\n", w, h)...)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var v byte
+			if lit(x/r.scale, y/r.scale) {
+				v = 0xFF
+			}
+			r.buf = append(r.buf, v, v, v)
+		}
+	}
+	_, r.Err = r.w.Write(r.buf)
+}
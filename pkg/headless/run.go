@@ -0,0 +1,33 @@
+package headless
+
+import (
+	"errors"
+
+	"github.com/JoshCooperr/chip8/pkg/vm"
+)
+
+// RunROM runs rom for up to cycles cycles without a window, deterministically: random numbers
+// always come from the same sequence and no keys are pressed. Every fault (a malformed
+// instruction, or the PC or a memory access going out of bounds) is returned as an error rather
+// than a panic, so it can safely run arbitrary bytes, e.g. when fuzzing. It returns the renderer
+// holding the final screen, and nil if the ROM runs its course or exits
+func RunROM(rom []byte, cycles int, opts ...vm.Option) (*Renderer, error) {
+	renderer := &Renderer{}
+	chip8 := &vm.VM{}
+	var seed byte
+	opts = append([]vm.Option{
+		vm.WithRandomFunc(func() byte {
+			seed = seed*5 + 1
+			return seed
+		}),
+		vm.WithPCPolicy(vm.PCError),
+	}, opts...)
+	chip8.Init(renderer, opts...)
+	if err := chip8.LoadROMBytes(rom); err != nil {
+		return renderer, err
+	}
+	if err := chip8.RunCycles(cycles); err != nil && !errors.Is(err, vm.ErrHalt) {
+		return renderer, err
+	}
+	return renderer, nil
+}
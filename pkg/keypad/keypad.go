@@ -1,7 +1,37 @@
 package keypad
 
-// TODO: Use https://github.com/gdamore/tcell/blob/master/TUTORIAL.md
+import "sync"
 
-type Keypad interface {
-	// Wait and handle keypress ReadByte() (byte, error) ??
+// TODO: Use https://github.com/gdamore/tcell/blob/master/TUTORIAL.md for a terminal keypad
+
+// Keypad is a 16 key hex keypad driven from code, e.g. by tests or a terminal front-end. It
+// implements vm.Input
+type Keypad struct {
+	mu      sync.Mutex
+	pressed [16]bool
+}
+
+func New() *Keypad {
+	return &Keypad{}
+}
+
+// Press holds key down
+func (k *Keypad) Press(key byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pressed[key&0xF] = true
+}
+
+// Release lets go of key
+func (k *Keypad) Release(key byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pressed[key&0xF] = false
+}
+
+// IsPressed reports whether key is currently held down
+func (k *Keypad) IsPressed(key byte) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.pressed[key&0xF]
 }
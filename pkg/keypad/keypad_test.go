@@ -1 +1,18 @@
 package keypad
+
+import "testing"
+
+func TestPressRelease(t *testing.T) {
+	k := New()
+	k.Press(0xA)
+	if !k.IsPressed(0xA) {
+		t.Error("expected key A to be pressed")
+	}
+	if k.IsPressed(0xB) {
+		t.Error("expected key B not to be pressed")
+	}
+	k.Release(0xA)
+	if k.IsPressed(0xA) {
+		t.Error("expected key A to be released")
+	}
+}
@@ -0,0 +1,37 @@
+package settings
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Number of ROMs remembered by AddRecentROM
+const maxRecentROMs = 10
+
+// RecentROMs returns the paths of the most recently opened ROMs, most recent first
+func RecentROMs() []string {
+	var recent []string
+	if err := readJSON(recentFile, &recent); err != nil {
+		return nil
+	}
+	return recent
+}
+
+// AddRecentROM records that the ROM at path was opened, moving it to the front of RecentROMs and
+// forgetting the oldest once there are too many
+func AddRecentROM(path string) error {
+	if abs, err := filepath.Abs(path); err == nil && !isURL(path) {
+		path = abs
+	}
+	recent := []string{path}
+	for _, p := range RecentROMs() {
+		if p != path && len(recent) < maxRecentROMs {
+			recent = append(recent, p)
+		}
+	}
+	return writeJSON(recentFile, recent)
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
@@ -0,0 +1,111 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/JoshCooperr/chip8/pkg/vm"
+)
+
+// Profile is the set of emulator settings that can be remembered for a ROM
+type Profile struct {
+	ClockSpeed     int       `json:"clock_speed"`
+	CyclesPerFrame int       `json:"cycles_per_frame"`
+	DrawCycleCost  int       `json:"draw_cycle_cost"`
+	XOChip         bool      `json:"xo_chip"`
+	Quirks         vm.Quirks `json:"quirks"`
+}
+
+// DefaultProfile returns the settings used for ROMs with no saved profile
+func DefaultProfile() Profile {
+	return Profile{ClockSpeed: 700}
+}
+
+// Options converts the profile into options for the VM
+func (p Profile) Options() []vm.Option {
+	return []vm.Option{
+		vm.WithClockSpeed(p.ClockSpeed),
+		vm.WithCyclesPerFrame(p.CyclesPerFrame),
+		vm.WithDrawCycleCost(p.DrawCycleCost),
+		vm.WithXOChip(p.XOChip),
+		vm.WithQuirks(p.Quirks),
+	}
+}
+
+// Names of the files, in the config directory, the settings are stored in
+const (
+	profilesFile = "roms.json"
+	recentFile   = "recent.json"
+)
+
+// path returns the location of the named settings file
+func path(name string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "chip8", name), nil
+}
+
+// readJSON decodes the named settings file into v, leaving v unchanged if the file doesn't exist
+func readJSON(name string, v interface{}) error {
+	p, err := path(name)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON encodes v into the named settings file, creating the config directory if needed
+func writeJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// load reads all of the saved profiles, keyed by ROM name
+func load() (map[string]Profile, error) {
+	profiles := map[string]Profile{}
+	if err := readJSON(profilesFile, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// SaveROMSettings remembers p as the profile for the ROM called name (e.g. its filename)
+func SaveROMSettings(name string, p Profile) error {
+	profiles, err := load()
+	if err != nil {
+		return err
+	}
+	profiles[name] = p
+	return writeJSON(profilesFile, profiles)
+}
+
+// LoadROMSettings returns the profile saved for the ROM called name, if there is one
+func LoadROMSettings(name string) (Profile, bool) {
+	profiles, err := load()
+	if err != nil {
+		return Profile{}, false
+	}
+	p, ok := profiles[name]
+	return p, ok
+}
@@ -0,0 +1,47 @@
+package settings
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecentROMs(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	if recent := RecentROMs(); len(recent) != 0 {
+		t.Fatalf("expected no recent ROMs, got %v", recent)
+	}
+
+	for i := 0; i < maxRecentROMs+2; i++ {
+		if err := AddRecentROM(fmt.Sprintf("/roms/%d.ch8", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopening a ROM moves it to the front rather than duplicating it
+	if err := AddRecentROM("/roms/5.ch8"); err != nil {
+		t.Fatal(err)
+	}
+
+	recent := RecentROMs()
+	if len(recent) != maxRecentROMs {
+		t.Fatalf("expected %d recent ROMs, got %v", maxRecentROMs, recent)
+	}
+	if recent[0] != "/roms/5.ch8" || recent[1] != "/roms/11.ch8" || recent[len(recent)-1] != "/roms/2.ch8" {
+		t.Errorf("expected the most recent ROMs first, got %v", recent)
+	}
+}
+
+func TestROMSettings(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	if _, ok := LoadROMSettings("game.ch8"); ok {
+		t.Fatal("expected no saved profile")
+	}
+	want := Profile{ClockSpeed: 1000, XOChip: true}
+	if err := SaveROMSettings("game.ch8", want); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := LoadROMSettings("game.ch8"); !ok || got != want {
+		t.Errorf("expected saved profile %+v, got %+v (%v)", want, got, ok)
+	}
+}
@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// Frames of the ROM run to calibrate the clock speed, and the most cycles run in each
+	calibrationFrames         = 120
+	calibrationCyclesPerFrame = 1000
+	// Headroom added to the busiest frames' cycles, so slightly busier frames don't run slow
+	calibrationMargin = 1.25
+	// Frames that must end in an idle loop for the ROM to be judged timer driven
+	minIdleFrames = calibrationFrames / 4
+	// Seed of the random bytes CXNN gives the ROM while calibrating
+	calibrationSeed = 1
+)
+
+// SuggestedClockSpeed estimates a clock speed for the loaded ROM, by running it for two seconds'
+// worth of frames (on a copy, leaving the VM as it is) and counting the cycles each frame takes
+// before the ROM settles into an idle loop waiting for the next frame, i.e. polling the delay
+// timer (FX07). The suggestion is enough cycles per second for nearly all of those frames, plus
+// some headroom. Calibration ends early at FX0A, as there's no one to press a key, or a jump to
+// itself, as the ROM has finished. If the ROM rarely idles, so its speed isn't paced by the
+// timers and there's nothing to measure, it returns the default clock speed. It's a heuristic:
+// ROMs that expect to run slower than they can should still be tuned by hand
+func (vm *VM) SuggestedClockSpeed() int {
+	vm.mu.Lock()
+	// The copy has its own random source, so as not to consume the VM's. It's seeded, so the
+	// suggestion for a ROM is always the same
+	r := rand.New(rand.NewSource(calibrationSeed))
+	c := &VM{}
+	c.Init(nil, WithQuirks(vm.quirks), WithXOChip(vm.xoChip), WithRandomFunc(func() byte {
+		return byte(r.Uint32())
+	}))
+	c.pcPolicy = vm.pcPolicy
+	c.strictOpcodes = vm.strictOpcodes
+	s := vm.snapshot()
+	c.restore(&s)
+	vm.mu.Unlock()
+
+	var busy []int
+	for f := 0; f < calibrationFrames; f++ {
+		cycles, idle, ok := c.calibrationFrame()
+		if !ok {
+			break
+		}
+		if idle {
+			busy = append(busy, cycles)
+		}
+		c.tickTimers()
+	}
+	if len(busy) < minIdleFrames {
+		return defaultClockSpeed
+	}
+	// The 90th percentile, ignoring the odd very busy frame, e.g. drawing the title screen
+	sort.Ints(busy)
+	cycles := busy[(len(busy)-1)*9/10]
+	return int(math.Ceil(float64(cycles) * timerFrequency * calibrationMargin))
+}
+
+// calibrationFrame runs a frame's worth of cycles until the ROM returns to polling the delay
+// timer, returning the cycles executed before it and whether it was reached. ok is false if
+// calibration can't go on, because the ROM stopped or is waiting for a key
+func (vm *VM) calibrationFrame() (cycles int, idle, ok bool) {
+	// Addresses of the polling instructions executed this frame. Reaching one again means the
+	// ROM is looping until something changes
+	polled := map[uint16]bool{}
+	for i := 0; i < calibrationCyclesPerFrame; i++ {
+		in := decode(vm.peekOpcode())
+		if in.Instr == 0xF000 && in.NN == 0x0A || in.Instr == 0x1000 && in.NNN == vm.pc {
+			return i, false, false
+		}
+		polling := in.Instr == 0xF000 && in.NN == 0x07
+		if polling && polled[vm.pc] {
+			return i, true, true
+		}
+		if polling {
+			polled[vm.pc] = true
+		}
+		vm.executeCycle()
+		if vm.stopErr != nil {
+			return i, false, false
+		}
+	}
+	return calibrationCyclesPerFrame, false, true
+}
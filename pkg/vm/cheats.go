@@ -0,0 +1,39 @@
+package vm
+
+// AddCheat patches memory at addr to hold value before every instruction, e.g. to keep a lives
+// counter topped up. The ROM can still write to addr, but never sees anything but value when it
+// reads it. Cheats can be added and removed while running, and apply until removed, even across
+// Reset and loading another ROM
+func (vm *VM) AddCheat(addr uint16, value byte) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.cheats == nil {
+		vm.cheats = map[uint16]byte{}
+	}
+	vm.cheats[addr%uint16(len(vm.memory))] = value
+}
+
+// RemoveCheat removes the cheat at addr added by AddCheat, leaving memory as it is
+func (vm *VM) RemoveCheat(addr uint16) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	delete(vm.cheats, addr%uint16(len(vm.memory)))
+}
+
+// Cheats returns the cheats currently applied, mapping each address to the value it's held at
+func (vm *VM) Cheats() map[uint16]byte {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	cheats := make(map[uint16]byte, len(vm.cheats))
+	for addr, value := range vm.cheats {
+		cheats[addr] = value
+	}
+	return cheats
+}
+
+// applyCheats writes the value of each cheat to memory
+func (vm *VM) applyCheats() {
+	for addr, value := range vm.cheats {
+		vm.memory[addr] = value
+	}
+}
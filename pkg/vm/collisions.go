@@ -0,0 +1,29 @@
+package vm
+
+// CollisionEvent is a DXYN instruction that turned pixels off, setting vf to 1, recorded when
+// WithCollisionLog is enabled
+type CollisionEvent struct {
+	// Number of instructions executed before the draw, and its address
+	Cycle uint64
+	PC    uint16
+	// Coordinates of the sprite's top left corner, after wrapping them to the screen
+	X, Y int
+	// Number of pixels the sprite turned off. With both XO-CHIP planes selected, a pixel turned
+	// off in each plane counts twice
+	Erased int
+}
+
+// CollisionEvents returns the collisions recorded since the VM was initialised, reset or the
+// events were last cleared, oldest first. It's empty unless WithCollisionLog is enabled
+func (vm *VM) CollisionEvents() []CollisionEvent {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return append([]CollisionEvent(nil), vm.collisions...)
+}
+
+// ClearCollisionEvents forgets the collisions recorded so far
+func (vm *VM) ClearCollisionEvents() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.collisions = nil
+}
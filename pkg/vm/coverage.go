@@ -0,0 +1,50 @@
+package vm
+
+// CoverageReport returns the set of opcode forms (e.g. "8XY4", "DXYN") executed since the VM was
+// initialised, if coverage tracking was enabled with WithCoverage, otherwise nil
+func (vm *VM) CoverageReport() map[string]bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.coverage == nil {
+		return nil
+	}
+	report := make(map[string]bool, len(vm.coverage))
+	for form := range vm.coverage {
+		report[form] = true
+	}
+	return report
+}
+
+// opcodeForm returns the form of an opcode as written in opcode tables, with its operands
+// replaced by X, Y, N, NN or NNN, e.g. 0x8124 -> "8XY4". Each 00NN opcode is a form of its own
+// (e.g. "00FB"), as that's where SUPER-CHIP and its derivatives add instructions. It's called
+// for every instruction executed, so it avoids fmt
+func opcodeForm(opcode uint16) string {
+	in := decode(opcode)
+	first := hexDigits[in.Instr>>12]
+	switch in.Instr {
+	case 0x0000:
+		if opcode == 0x0230 || opcode&0xFF00 == 0 && opcode != 0 {
+			return string([]byte{'0', hexDigits[opcode>>8], hexDigits[in.NN>>4], hexDigits[in.NN&0xF]})
+		}
+		return "0NNN"
+	case 0x1000, 0x2000, 0xA000, 0xB000:
+		return string([]byte{first, 'N', 'N', 'N'})
+	case 0x3000, 0x4000, 0x6000, 0x7000, 0xC000:
+		return string([]byte{first, 'X', 'N', 'N'})
+	case 0x5000, 0x8000, 0x9000:
+		return string([]byte{first, 'X', 'Y', hexDigits[in.N]})
+	case 0xD000:
+		return "DXYN"
+	}
+	// EXNN and FXNN, including the XO-CHIP FN01 and F002
+	switch {
+	case opcode == 0xF002:
+		return "F002"
+	case in.Instr == 0xF000 && in.NN == 0x01:
+		return "FN01"
+	}
+	return string([]byte{first, 'X', hexDigits[in.NN>>4], hexDigits[in.NN&0xF]})
+}
+
+const hexDigits = "0123456789ABCDEF"
@@ -0,0 +1,149 @@
+package vm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// PeekOpcode returns the opcode at the PC, i.e. the next instruction to be executed, without
+// executing it or advancing the PC. If the PC is out of bounds it returns 0
+func (vm *VM) PeekOpcode() uint16 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.peekOpcode()
+}
+
+func (vm *VM) peekOpcode() uint16 {
+	if int(vm.pc)+1 >= len(vm.memory) {
+		return 0
+	}
+	return vm.fetch()
+}
+
+// PeekDisassembly returns the disassembly of the next instruction to be executed
+func (vm *VM) PeekDisassembly() string {
+	return Disassemble(vm.PeekOpcode())
+}
+
+// CurrentInstruction decodes the instruction at the PC, i.e. the next to be executed, without
+// executing it, e.g. for a debugger to show its operands alongside the registers they refer to.
+// Its mnemonic is as given by Disassemble, and its description is the opcode registry's, or empty
+// if it isn't a known opcode
+func (vm *VM) CurrentInstruction() Instruction {
+	in := decode(vm.PeekOpcode())
+	in.Mnemonic = Disassemble(in.Opcode)
+	in.Description = opcodesByForm[opcodeForm(in.Opcode)].Description
+	return in
+}
+
+// DisasmLine is a disassembled instruction in memory, see DisassembleWindow
+type DisasmLine struct {
+	Addr     uint16
+	Bytes    [2]byte
+	Mnemonic string
+	// Whether this is the instruction at the PC, i.e. the next to be executed
+	Current bool
+}
+
+func (l DisasmLine) String() string {
+	marker := " "
+	if l.Current {
+		marker = ">"
+	}
+	return fmt.Sprintf("%s %#04x  %02X %02X  %s", marker, l.Addr, l.Bytes[0], l.Bytes[1], l.Mnemonic)
+}
+
+// DisassembleWindow disassembles the instructions around the PC, from before instructions before
+// it to after instructions after it, e.g. for a debugger's code view. The window is cut short
+// where it would run past either end of memory
+func (vm *VM) DisassembleWindow(before, after int) []DisasmLine {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	start := int(vm.pc) - 2*before
+	for start < 0 {
+		start += 2
+	}
+	end := int(vm.pc) + 2*after
+	for end+1 >= len(vm.memory) {
+		end -= 2
+	}
+	var lines []DisasmLine
+	for addr := start; addr <= end; addr += 2 {
+		b := [2]byte{vm.memory[addr], vm.memory[addr+1]}
+		lines = append(lines, DisasmLine{
+			Addr:     uint16(addr),
+			Bytes:    b,
+			Mnemonic: Disassemble(uint16(b[0])<<8 | uint16(b[1])),
+			Current:  addr == int(vm.pc),
+		})
+	}
+	return lines
+}
+
+// SpriteAt returns the on/off grid for the height byte sprite stored at addr, indexed [row][col],
+// e.g. to preview what a DXYN instruction is about to draw. Rows past the end of memory are
+// omitted
+func (vm *VM) SpriteAt(addr uint16, height int) [][]bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	var sprite [][]bool
+	for y := 0; y < height && int(addr)+y < len(vm.memory); y++ {
+		row := make([]bool, 8)
+		for x := range row {
+			row[x] = spriteBit(vm.memory[int(addr)+y], x)
+		}
+		sprite = append(sprite, row)
+	}
+	return sprite
+}
+
+// MemoryMap describes the layout of memory: the region reserved for the interpreter and font,
+// the loaded ROM and the free space after it
+func (vm *VM) MemoryMap() string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	var sb strings.Builder
+	region := func(start, end int, name string) {
+		if end >= start {
+			fmt.Fprintf(&sb, "0x%03X-0x%03X  %-18s %4d bytes\n", start, end, name, end-start+1)
+		}
+	}
+	romEnd := 0x200 + vm.romSize - 1
+	region(0x000, 0x1FF, "interpreter/font")
+	region(0x200, romEnd, "program (ROM)")
+	region(romEnd+1, len(vm.memory)-1, "free")
+	return sb.String()
+}
+
+// FrameHash returns a hash of the pixel buffer, so that a test runner can tell when the screen has
+// stopped changing (e.g. the ROM has finished or is waiting in an idle loop) by comparing the
+// hashes of consecutive frames
+func (vm *VM) FrameHash() uint64 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	h := fnv.New64a()
+	for _, col := range vm.pixels {
+		h.Write(col[:])
+	}
+	return h.Sum64()
+}
+
+// MemDiff is a memory address whose value differs between two snapshots
+type MemDiff struct {
+	Addr   uint16
+	Before byte
+	After  byte
+}
+
+// DiffMemory returns the addresses whose values changed from snapshot a to snapshot b, in address
+// order, e.g. to see exactly what a subroutine wrote. It allocates only for the result
+func DiffMemory(a, b Snapshot) []MemDiff {
+	var diffs []MemDiff
+	for addr := range a.memory {
+		if a.memory[addr] != b.memory[addr] {
+			diffs = append(diffs, MemDiff{Addr: uint16(addr), Before: a.memory[addr], After: b.memory[addr]})
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StartDebugServer listens on addr (e.g. "localhost:6502") for TCP connections from debugging
+// tools, and serves each one in the background until the returned listener is closed. The
+// protocol is line based: each command is a line of space separated words, and is answered by a
+// line starting "ok", followed by any result, or "error" followed by the reason. Numbers may be
+// given in decimal or, prefixed with 0x, in hex.
+//
+//	step             execute the next instruction, ok <pc>
+//	continue         resume execution
+//	pause            pause execution, ok <pc>
+//	break <addr>     pause before executing the instruction at addr, see AddBreakpoint
+//	clear <addr>     remove the breakpoint at addr
+//	regs             ok pc=<pc> i=<i> sp=<sp> dt=<delay> st=<sound> v0=<v0> ... vf=<vf>
+//	mem <addr> <n>   ok <n bytes of memory from addr, in hex>
+//	frame            ok <the screen, encoded by EncodeFramebuffer, in hex>
+//	stream           ok, then "frame <hex>" lines like frame's whenever the screen changes
+func (vm *VM) StartDebugServer(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go vm.serveDebug(conn)
+		}
+	}()
+	return l, nil
+}
+
+// How often a streaming debug connection checks for changes to the screen
+const debugStreamInterval = time.Second / timerFrequency
+
+// debugConn is a connection to the debug server. Streamed frames are written from another
+// goroutine, so writes are serialised
+type debugConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *debugConn) reply(format string, a ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c, format+"\n", a...)
+}
+
+func (vm *VM) serveDebug(conn net.Conn) {
+	c := &debugConn{Conn: conn}
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	streaming := false
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		result, err := vm.debugCommand(fields)
+		if err != nil {
+			c.reply("error %v", err)
+			continue
+		}
+		if result == "" {
+			c.reply("ok")
+		} else {
+			c.reply("ok %s", result)
+		}
+		if fields[0] == "stream" && !streaming {
+			streaming = true
+			go vm.streamFrames(c, done)
+		}
+	}
+}
+
+// debugCommand carries out a debug server command, returning the result to reply with
+func (vm *VM) debugCommand(fields []string) (string, error) {
+	args := make([]uint16, len(fields)-1)
+	for i, f := range fields[1:] {
+		n, err := strconv.ParseUint(f, 0, 16)
+		if err != nil {
+			return "", fmt.Errorf("bad number %q", f)
+		}
+		args[i] = uint16(n)
+	}
+	want := map[string]int{"break": 1, "clear": 1, "mem": 2}[fields[0]]
+	if len(args) != want {
+		return "", fmt.Errorf("%s takes %d arguments", fields[0], want)
+	}
+
+	switch fields[0] {
+	case "step":
+		// Reply with the PC as the step left it, before the run loop can move it on
+		vm.mu.Lock()
+		defer vm.mu.Unlock()
+		if err := vm.step(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%#04x", vm.pc), nil
+	case "continue":
+		vm.Resume()
+	case "pause":
+		vm.mu.Lock()
+		defer vm.mu.Unlock()
+		vm.pause()
+		return fmt.Sprintf("%#04x", vm.pc), nil
+	case "break":
+		vm.AddBreakpoint(args[0])
+	case "clear":
+		vm.RemoveBreakpoint(args[0])
+	case "regs":
+		vm.mu.Lock()
+		defer vm.mu.Unlock()
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "pc=%#04x i=%#04x sp=%d dt=%d st=%d", vm.pc, vm.index, vm.sp, vm.delayTimer, vm.soundTimer)
+		for i, v := range vm.variables {
+			fmt.Fprintf(&sb, " v%x=%#02x", i, v)
+		}
+		return sb.String(), nil
+	case "mem":
+		vm.mu.Lock()
+		defer vm.mu.Unlock()
+		if err := vm.checkMemory(args[0], int(args[1])); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(vm.memory[args[0] : args[0]+args[1]]), nil
+	case "frame":
+		return hex.EncodeToString(vm.EncodeFramebuffer()), nil
+	case "stream":
+	default:
+		return "", errors.New("unknown command")
+	}
+	return "", nil
+}
+
+// streamFrames writes the screen to c whenever it changes, until done is closed
+func (vm *VM) streamFrames(c *debugConn, done chan struct{}) {
+	ticker := time.NewTicker(debugStreamInterval)
+	defer ticker.Stop()
+	var last uint64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if hash := vm.FrameHash(); hash != last {
+			last = hash
+			c.reply("frame %s", hex.EncodeToString(vm.EncodeFramebuffer()))
+		}
+	}
+}
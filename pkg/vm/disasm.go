@@ -0,0 +1,183 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Most bytes listed on each data line by DumpDisassembly
+const dataLineBytes = 8
+
+// Disassemble returns the assembly mnemonic for an opcode (e.g. 0x6A42 -> "LD VA, 0x42"), or a
+// data directive for opcodes that aren't recognised
+func Disassemble(opcode uint16) string {
+	in := decode(opcode)
+	switch in.Instr {
+	case 0x0000:
+		// The HIRES mode's clear screen
+		if opcode == 0x0230 {
+			return "CLS"
+		}
+		switch in.NN {
+		case 0xE0:
+			return "CLS"
+		case 0xEE:
+			return "RET"
+		case 0xFD:
+			return "EXIT"
+		}
+	case 0x1000:
+		return fmt.Sprintf("JP 0x%03X", in.NNN)
+	case 0x2000:
+		return fmt.Sprintf("CALL 0x%03X", in.NNN)
+	case 0x3000:
+		return fmt.Sprintf("SE V%X, 0x%02X", in.X, in.NN)
+	case 0x4000:
+		return fmt.Sprintf("SNE V%X, 0x%02X", in.X, in.NN)
+	case 0x5000:
+		switch in.N {
+		case 0x0:
+			return fmt.Sprintf("SE V%X, V%X", in.X, in.Y)
+		case 0x2:
+			return fmt.Sprintf("SAVE V%X-V%X", in.X, in.Y)
+		case 0x3:
+			return fmt.Sprintf("LOAD V%X-V%X", in.X, in.Y)
+		}
+	case 0x6000:
+		return fmt.Sprintf("LD V%X, 0x%02X", in.X, in.NN)
+	case 0x7000:
+		return fmt.Sprintf("ADD V%X, 0x%02X", in.X, in.NN)
+	case 0x8000:
+		mnemonics := map[uint16]string{
+			0x0: "LD", 0x1: "OR", 0x2: "AND", 0x3: "XOR", 0x4: "ADD",
+			0x5: "SUB", 0x6: "SHR", 0x7: "SUBN", 0xE: "SHL",
+		}
+		if m, ok := mnemonics[in.N]; ok {
+			return fmt.Sprintf("%s V%X, V%X", m, in.X, in.Y)
+		}
+	case 0x9000:
+		if in.N == 0x0 {
+			return fmt.Sprintf("SNE V%X, V%X", in.X, in.Y)
+		}
+	case 0xA000:
+		return fmt.Sprintf("LD I, 0x%03X", in.NNN)
+	case 0xB000:
+		return fmt.Sprintf("JP V0, 0x%03X", in.NNN)
+	case 0xC000:
+		return fmt.Sprintf("RND V%X, 0x%02X", in.X, in.NN)
+	case 0xD000:
+		return fmt.Sprintf("DRW V%X, V%X, %d", in.X, in.Y, in.N)
+	case 0xE000:
+		switch in.NN {
+		case 0x9E:
+			return fmt.Sprintf("SKP V%X", in.X)
+		case 0xA1:
+			return fmt.Sprintf("SKNP V%X", in.X)
+		}
+	case 0xF000:
+		// XO-CHIP's FN01 takes a plane mask rather than a register, and F002 no operand
+		switch {
+		case in.NN == 0x01:
+			return fmt.Sprintf("PLANE %d", in.X)
+		case opcode == 0xF002:
+			return "AUDIO"
+		}
+		formats := map[uint16]string{
+			0x07: "LD V%X, DT", 0x0A: "LD V%X, K", 0x15: "LD DT, V%X", 0x18: "LD ST, V%X",
+			0x1E: "ADD I, V%X", 0x29: "LD F, V%X", 0x33: "LD B, V%X", 0x3A: "PITCH V%X",
+			0x55: "LD [I], V%X", 0x65: "LD V%X, [I]",
+		}
+		if f, ok := formats[in.NN]; ok {
+			return fmt.Sprintf(f, in.X)
+		}
+	}
+	return fmt.Sprintf("DW 0x%04X", opcode)
+}
+
+// DumpDisassembly writes the disassembly of the loaded ROM to w, one instruction per line with its
+// address and bytes, e.g. for reverse engineering or to refer to an instruction in a bug report.
+// Code is told apart from data (sprites, tables) by following the ROM's control flow from 0x200:
+// bytes never reached are listed as DB data lines. It's rudimentary, computed jumps (BNNN) aren't
+// followed, so code only reached through them is listed as data
+func (vm *VM) DumpDisassembly(w io.Writer) error {
+	vm.mu.Lock()
+	end := 0x200 + vm.romSize
+	memory := vm.memory
+	vm.mu.Unlock()
+
+	code := reachable(memory[:], 0x200, end)
+	for addr := 0x200; addr < end; {
+		if code[addr] {
+			opcode := uint16(memory[addr])<<8 | uint16(memory[addr+1])
+			if _, err := fmt.Fprintf(w, "0x%03X  %04X  %s\n", addr, opcode, Disassemble(opcode)); err != nil {
+				return err
+			}
+			addr += 2
+			continue
+		}
+		var data []string
+		for ; addr < end && !code[addr] && len(data) < dataLineBytes; addr++ {
+			data = append(data, fmt.Sprintf("0x%02X", memory[addr]))
+		}
+		if _, err := fmt.Fprintf(w, "0x%03X  DB %s\n", addr-len(data), strings.Join(data, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subroutines returns the addresses called as subroutines (by 2NNN) from the loaded ROM, in
+// ascending order, e.g. for a debugger to list as places to jump to. Like DumpDisassembly, only
+// calls reachable from 0x200 are found, so that data isn't mistaken for them
+func (vm *VM) Subroutines() []uint16 {
+	vm.mu.Lock()
+	end := 0x200 + vm.romSize
+	memory := vm.memory
+	vm.mu.Unlock()
+
+	called := map[uint16]bool{}
+	for addr := range reachable(memory[:], 0x200, end) {
+		if in := decode(uint16(memory[addr])<<8 | uint16(memory[addr+1])); in.Instr == 0x2000 {
+			called[in.NNN] = true
+		}
+	}
+	subroutines := make([]uint16, 0, len(called))
+	for addr := range called {
+		subroutines = append(subroutines, addr)
+	}
+	sort.Slice(subroutines, func(i, j int) bool { return subroutines[i] < subroutines[j] })
+	return subroutines
+}
+
+// reachable returns the addresses in [start, end) of the instructions that can be executed,
+// following the control flow from start
+func reachable(memory []byte, start, end int) map[int]bool {
+	code := map[int]bool{}
+	pending := []int{start}
+	for len(pending) > 0 {
+		addr := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if addr < start || addr+1 >= end || code[addr] {
+			continue
+		}
+		code[addr] = true
+		in := decode(uint16(memory[addr])<<8 | uint16(memory[addr+1]))
+		switch {
+		case in.Opcode == 0x00EE || in.Opcode == 0x00FD || in.Instr == 0xB000:
+			// Returns, exits and computed jumps end this path
+		case in.Instr == 0x1000:
+			pending = append(pending, int(in.NNN))
+		case in.Instr == 0x2000:
+			pending = append(pending, int(in.NNN), addr+2)
+		case in.Instr == 0x3000 || in.Instr == 0x4000 || in.Instr == 0x5000 || in.Instr == 0x9000 ||
+			in.Instr == 0xE000:
+			// Skips may continue at either of the next two instructions
+			pending = append(pending, addr+2, addr+4)
+		default:
+			pending = append(pending, addr+2)
+		}
+	}
+	return code
+}
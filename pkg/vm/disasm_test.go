@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	tests := map[uint16]string{
+		0x00E0: "CLS",
+		0x00EE: "RET",
+		0x00FD: "EXIT",
+		0x1ABC: "JP 0xABC",
+		0x2ABC: "CALL 0xABC",
+		0x3142: "SE V1, 0x42",
+		0x5120: "SE V1, V2",
+		0x6A42: "LD VA, 0x42",
+		0x812E: "SHL V1, V2",
+		0xA123: "LD I, 0x123",
+		0xD015: "DRW V0, V1, 5",
+		0xF033: "LD B, V0",
+		0xF165: "LD V1, [I]",
+		0xF301: "PLANE 3",
+		0xF002: "AUDIO",
+		0xF43A: "PITCH V4",
+		0xF102: "DW 0xF102",
+		0x8128: "DW 0x8128",
+		0xFFFF: "DW 0xFFFF",
+	}
+	for opcode, want := range tests {
+		if got := Disassemble(opcode); got != want {
+			t.Errorf("Disassemble(%04X) = %q, want %q", opcode, got, want)
+		}
+	}
+}
+
+func TestDumpDisassembly(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil)
+	rom := []byte{
+		0x22, 0x06, // CALL 0x206
+		0x12, 0x02, // JP 0x202
+		0xF0, 0x90, // A sprite, never executed
+		0x60, 0x01, // LD V0, 0x01
+		0x00, 0xEE, // RET
+		0xFF,
+	}
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err := vm.DumpDisassembly(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `0x200  2206  CALL 0x206
+0x202  1202  JP 0x202
+0x204  DB 0xF0, 0x90
+0x206  6001  LD V0, 0x01
+0x208  00EE  RET
+0x20A  DB 0xFF
+`
+	if got := sb.String(); got != want {
+		t.Errorf("expected disassembly:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestSubroutines(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil)
+	rom := []byte{
+		0x22, 0x0A, // CALL 0x20A
+		0x22, 0x08, // CALL 0x208
+		0x22, 0x0A, // CALL 0x20A again
+		0x12, 0x06, // JP 0x206
+		0x00, 0xEE, // RET
+		0x00, 0xEE, // RET
+		0x23, 0x00, // Data that looks like CALL 0x300, never executed
+	}
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%#x", vm.Subroutines()); got != "[0x208 0x20a]" {
+		t.Errorf("expected subroutines [0x208 0x20a], got %s", got)
+	}
+}
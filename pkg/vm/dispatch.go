@@ -0,0 +1,505 @@
+package vm
+
+import "strings"
+
+// Handler carries out a decoded instruction of one opcode form, e.g. "8XY4". The PC already
+// points to the next instruction. It returns an error, leaving the VM unchanged, if the
+// instruction can't be executed. Handlers are called with the VM locked, so a custom handler (see
+// WithHandler) mustn't call its locking methods
+type Handler func(vm *VM, in Instruction) error
+
+// handlers maps the form of each CHIP-8 opcode, as given by opcodeForm, to its handler
+var handlers = map[string]Handler{
+	"00E0": op00E0,
+	"0230": op0230,
+	"00EE": op00EE,
+	"00FD": op00FD,
+	"0NNN": ignore,
+	"1NNN": op1NNN,
+	"2NNN": op2NNN,
+	"3XNN": op3XNN,
+	"4XNN": op4XNN,
+	"5XY0": op5XY0,
+	"6XNN": op6XNN,
+	"7XNN": op7XNN,
+	"8XY0": op8XY0,
+	"8XY1": op8XY1,
+	"8XY2": op8XY2,
+	"8XY3": op8XY3,
+	"8XY4": op8XY4,
+	"8XY5": op8XY5,
+	"8XY6": op8XY6,
+	"8XY7": op8XY7,
+	"8XYE": op8XYE,
+	// The remaining 8XYN are ignored, rather than being unknown opcodes
+	"8XY8": ignore,
+	"8XY9": ignore,
+	"8XYA": ignore,
+	"8XYB": ignore,
+	"8XYC": ignore,
+	"8XYD": ignore,
+	"8XYF": ignore,
+	"9XY0": op9XY0,
+	"ANNN": opANNN,
+	"BNNN": opBNNN,
+	"CXNN": opCXNN,
+	"DXYN": opDXYN,
+	"EX9E": opEX9E,
+	"EXA1": opEXA1,
+	"FX07": opFX07,
+	"FX0A": opFX0A,
+	"FX15": opFX15,
+	"FX18": opFX18,
+	"FX1E": opFX1E,
+	"FX29": opFX29,
+	"FX33": opFX33,
+	"FX55": opFX55,
+	"FX65": opFX65,
+}
+
+// xoChipHandlers adds the XO-CHIP opcodes to handlers, when enabled by WithXOChip
+var xoChipHandlers = map[string]Handler{
+	"5XY2": op5XY2,
+	"5XY3": op5XY3,
+	"FN01": opFN01,
+	"F002": opF002,
+	"FX3A": opFX3A,
+}
+
+// execute carries out a decoded instruction, the PC should already point to the next instruction.
+// It returns an error, leaving the VM unchanged, if the instruction can't be executed
+func (vm *VM) execute(in Instruction) error {
+	h := vm.handler(opcodeForm(in.Opcode))
+	if h == nil {
+		return ErrUnknownOpcode
+	}
+	return h(vm, in)
+}
+
+// handler returns the handler for an opcode form: one set by WithHandler, otherwise the XO-CHIP
+// one if enabled, otherwise the CHIP-8 one. Unknown 00NN and FXNN opcodes have handlers of their
+// own, and otherwise it's nil if the form is unknown
+func (vm *VM) handler(form string) Handler {
+	if h, ok := vm.handlers[form]; ok {
+		return h
+	}
+	if vm.xoChip {
+		if h, ok := xoChipHandlers[form]; ok {
+			return h
+		}
+	}
+	if h, ok := handlers[form]; ok {
+		return h
+	}
+	if strings.HasPrefix(form, "00") {
+		return op00NN
+	}
+	if strings.HasPrefix(form, "F") {
+		return opFXNN
+	}
+	return nil
+}
+
+// ignore is the handler for opcodes that do nothing, including 0NNN, which calls a machine code
+// routine of the original interpreter
+func ignore(vm *VM, in Instruction) error {
+	return nil
+}
+
+func op00E0(vm *VM, in Instruction) error {
+	// Clear the screen (only the selected planes). The whole buffer is cleared, so it's the full
+	// 64x64 screen in HIRES mode, and switching mode never reveals stale pixels
+	vm.clearScreen()
+	if vm.quirks.ClearResetsVF {
+		vm.setRegister(0xF, 0)
+	}
+	return nil
+}
+
+func op0230(vm *VM, in Instruction) error {
+	// HIRES clear screen. Otherwise, like other 0NNN machine code routines, it's ignored
+	if vm.hires {
+		vm.clearScreen()
+	}
+	return nil
+}
+
+func op00EE(vm *VM, in Instruction) error {
+	// Return from a subroutine, pop address from stack and assign to PC
+	if vm.sp == 0 {
+		return ErrStackUnderflow
+	}
+	vm.pc = vm.stack[vm.sp]
+	vm.sp -= 1
+	return nil
+}
+
+func op00FD(vm *VM, in Instruction) error {
+	// SUPER-CHIP exit interpreter. Stay on this instruction, so the ROM goes no further even if
+	// run again
+	vm.pc -= 2
+	vm.stopErr = ErrHalt
+	return nil
+}
+
+func op00NN(vm *VM, in Instruction) error {
+	// Unlike other 0NNN routines, 00NN is the family SUPER-CHIP and its derivatives add
+	// instructions to (e.g. 00FB scroll right, 00FA), so one not implemented here is an error, or
+	// optionally logged and ignored. 0000, i.e. empty memory, is left as a routine
+	if !vm.ignoreUnknown00NN {
+		return ErrUnknownOpcode
+	}
+	vm.warnUnknown()
+	return nil
+}
+
+func opFXNN(vm *VM, in Instruction) error {
+	// FXNN is another family extensions add instructions to (e.g. SUPER-CHIP's FX30, FX75 and
+	// FX85, or XO-CHIP's FX3A when it's disabled), so like 00NN, one not implemented here is an
+	// error, or optionally logged and ignored
+	if !vm.ignoreUnknownFXNN {
+		return ErrUnknownOpcode
+	}
+	vm.warnUnknown()
+	return nil
+}
+
+func op1NNN(vm *VM, in Instruction) error {
+	// Jump by setting PC to nnn
+	vm.pc = in.NNN
+	return nil
+}
+
+func op2NNN(vm *VM, in Instruction) error {
+	// Call the subroutine at nnn in memory, set PC to this after saving current value to the stack
+	// so the subroutine can return later
+	if int(vm.sp)+1 >= len(vm.stack) {
+		return ErrStackOverflow
+	}
+	vm.sp += 1
+	vm.stack[vm.sp] = vm.pc
+	vm.pc = in.NNN
+	return nil
+}
+
+func op3XNN(vm *VM, in Instruction) error {
+	// Skip the next instruction if the value in register vx == nn
+	if vm.variables[in.X] == uint8(in.NN) {
+		vm.pc += 2
+	}
+	return nil
+}
+
+func op4XNN(vm *VM, in Instruction) error {
+	// Skip the next instruction if the value in register vx != nn
+	if vm.variables[in.X] != uint8(in.NN) {
+		vm.pc += 2
+	}
+	return nil
+}
+
+func op5XY0(vm *VM, in Instruction) error {
+	// Skip the next instruction if the values in registers vx == vy
+	if vm.variables[in.X] == vm.variables[in.Y] {
+		vm.pc += 2
+	}
+	return nil
+}
+
+func op5XY2(vm *VM, in Instruction) error {
+	// Save the values in registers vx..vy into memory (addresses determined by index register,
+	// which is left unchanged)
+	regs := registerRange(in.X, in.Y)
+	if err := vm.checkWrite(vm.index, len(regs)); err != nil {
+		return err
+	}
+	for i, r := range regs {
+		vm.memory[vm.index+uint16(i)] = vm.variables[r]
+	}
+	return nil
+}
+
+func op5XY3(vm *VM, in Instruction) error {
+	// Load values from memory (addresses determined by index register) into registers vx..vy
+	regs := registerRange(in.X, in.Y)
+	if err := vm.checkMemory(vm.index, len(regs)); err != nil {
+		return err
+	}
+	for i, r := range regs {
+		vm.setRegister(r, vm.memory[vm.index+uint16(i)])
+	}
+	return nil
+}
+
+func op6XNN(vm *VM, in Instruction) error {
+	// Set register vx to the value in nn
+	vm.setRegister(in.X, uint8(in.NN))
+	return nil
+}
+
+func op7XNN(vm *VM, in Instruction) error {
+	// Add to register vx the value in nn
+	vm.checkOverflow(in.X, vm.variables[in.X], uint8(in.NN))
+	vm.setRegister(in.X, vm.variables[in.X]+uint8(in.NN))
+	return nil
+}
+
+func op8XY0(vm *VM, in Instruction) error {
+	// Set register vx = vy
+	vm.setRegister(in.X, vm.variables[in.Y])
+	return nil
+}
+
+func op8XY1(vm *VM, in Instruction) error {
+	// Set register vx = vx OR vy
+	vm.setRegister(in.X, vm.variables[in.X]|vm.variables[in.Y])
+	vm.logicQuirk()
+	return nil
+}
+
+func op8XY2(vm *VM, in Instruction) error {
+	// Set register vx = vx AND vy
+	vm.setRegister(in.X, vm.variables[in.X]&vm.variables[in.Y])
+	vm.logicQuirk()
+	return nil
+}
+
+func op8XY3(vm *VM, in Instruction) error {
+	// Set register vx = vx XOR vy
+	vm.setRegister(in.X, vm.variables[in.X]^vm.variables[in.Y])
+	vm.logicQuirk()
+	return nil
+}
+
+func op8XY4(vm *VM, in Instruction) error {
+	// Set register vx = vx + vy
+	vm.checkOverflow(in.X, vm.variables[in.X], vm.variables[in.Y])
+	vm.setRegister(in.X, vm.variables[in.X]+vm.variables[in.Y])
+	return nil
+}
+
+func op8XY5(vm *VM, in Instruction) error {
+	// Set register vx = vx - vy
+	vm.checkBorrow(in.X, vm.variables[in.X], vm.variables[in.Y])
+	vm.setRegister(in.X, vm.variables[in.X]-vm.variables[in.Y])
+	return nil
+}
+
+func op8XY6(vm *VM, in Instruction) error {
+	// Set register vx = vy >> 1, or vx >> 1 with the ShiftInPlace quirk, and vf = the bit shifted
+	// out of that same register. vf is written last, so it holds the flag even if it's vx
+	src := vm.shiftSource(in.X, in.Y)
+	vm.setRegister(in.X, src>>1)
+	vm.setRegister(0xF, src&0x01)
+	return nil
+}
+
+func op8XY7(vm *VM, in Instruction) error {
+	// Set register vx = vy - vx
+	vm.checkBorrow(in.X, vm.variables[in.Y], vm.variables[in.X])
+	vm.setRegister(in.X, vm.variables[in.Y]-vm.variables[in.X])
+	return nil
+}
+
+func op8XYE(vm *VM, in Instruction) error {
+	// Set register vx = vy << 1, or vx << 1 with the ShiftInPlace quirk, and vf = the bit shifted
+	// out of that same register, written last like 8XY6
+	src := vm.shiftSource(in.X, in.Y)
+	vm.setRegister(in.X, src<<1)
+	vm.setRegister(0xF, src>>7)
+	return nil
+}
+
+func op9XY0(vm *VM, in Instruction) error {
+	// Skip the next instruction if the values in registers vx != vy
+	if vm.variables[in.X] != vm.variables[in.Y] {
+		vm.pc += 2
+	}
+	return nil
+}
+
+func opANNN(vm *VM, in Instruction) error {
+	// Set the index register to the value in nnn
+	vm.index = in.NNN
+	return nil
+}
+
+func opBNNN(vm *VM, in Instruction) error {
+	// Jump with offset, set PC to nnn + v0, or to xnn + vx with the JumpWithVX quirk (see
+	// https://tobiasvl.github.io/blog/write-a-chip-8-emulator/#bnnn-jump-with-offset)
+	vm.warnQuirk("JumpWithVX", vm.quirks.JumpWithVX)
+	if vm.quirks.JumpWithVX {
+		vm.pc = in.NNN + uint16(vm.variables[in.X])
+	} else {
+		vm.pc = in.NNN + uint16(vm.variables[0])
+	}
+	return nil
+}
+
+func opCXNN(vm *VM, in Instruction) error {
+	// Generate a random number, r, and set register vx = r AND nn
+	r, err := vm.random()
+	if err != nil {
+		return err
+	}
+	vm.setRegister(in.X, r&uint8(in.NN))
+	return nil
+}
+
+func opDXYN(vm *VM, in Instruction) error {
+	// Get the x, y coords from the vx, vy registers as the starting coordinates to draw the sprite
+	// from (these coordinates wrap to the screen size, hence bitwise AND). Register vf is set if
+	// any pixels were turned off. vf is only written after drawing, so it may also be used as one
+	// of the coordinate registers.
+	// The sprite is 8 pixels wide and n rows tall. With XO-CHIP, which draws SUPER-CHIP's large
+	// sprites in every mode, n = 0 is a 16x16 sprite of 2 bytes per row. Otherwise a 0 row sprite
+	// draws nothing, but still clears vf and counts as a draw
+	rows, width := int(in.N), 8
+	if in.N == 0 && vm.xoChip {
+		rows, width = 16, 16
+	}
+	if err := vm.checkMemory(vm.index, rows*width/8*vm.planeCount()); err != nil {
+		return err
+	}
+	xcoord, ycoord := vm.variables[in.X]&63, vm.variables[in.Y]&uint8(vm.screenHeight()-1)
+	if vm.drawDryRun != nil {
+		vm.drawDryRun(vm.drawEvent(xcoord, ycoord, rows, width))
+		return nil
+	}
+	erased := vm.drawSprite(xcoord, ycoord, rows, width)
+	if erased > 0 {
+		if vm.logCollisions {
+			vm.collisions = append(vm.collisions, CollisionEvent{
+				Cycle: vm.totalCycles, PC: vm.pc - 2, X: int(xcoord), Y: int(ycoord), Erased: erased,
+			})
+		}
+		vm.setRegister(0xF, 1)
+		if vm.collisionBeep != nil {
+			vm.collisionBeep()
+		}
+	} else {
+		vm.setRegister(0xF, 0)
+	}
+	vm.dirty = true
+	if !vm.drawThrottle && vm.cyclesPerFrame == 0 {
+		vm.present()
+	}
+	vm.stall = vm.drawCycleCost
+	return nil
+}
+
+func opEX9E(vm *VM, in Instruction) error {
+	// Skip the next instruction if the key in vx is pressed
+	if vm.keyPressed(vm.variables[in.X]) {
+		vm.pc += 2
+	}
+	return nil
+}
+
+func opEXA1(vm *VM, in Instruction) error {
+	// Skip the next instruction if the key in vx is not pressed
+	if !vm.keyPressed(vm.variables[in.X]) {
+		vm.pc += 2
+	}
+	return nil
+}
+
+func opFN01(vm *VM, in Instruction) error {
+	// Select the planes (bitmask in x) that drawing and clearing affect
+	vm.selectedPlane = uint8(in.X) & 0x3
+	return nil
+}
+
+func opF002(vm *VM, in Instruction) error {
+	// Load the 16 byte audio pattern from memory (addresses determined by index register)
+	if err := vm.checkMemory(vm.index, len(vm.audioPattern)); err != nil {
+		return err
+	}
+	copy(vm.audioPattern[:], vm.memory[vm.index:])
+	return nil
+}
+
+func opFX3A(vm *VM, in Instruction) error {
+	// Set the audio pattern playback pitch to the value in vx
+	vm.pitch = vm.variables[in.X]
+	return nil
+}
+
+func opFX07(vm *VM, in Instruction) error {
+	// Set vx to the value of the delay timer
+	vm.setRegister(in.X, vm.delayTimer)
+	return nil
+}
+
+func opFX0A(vm *VM, in Instruction) error {
+	// Wait for a key to be pressed and released, then set vx to its hex value. Rather than
+	// blocking, repeat this instruction until then, so the timers keep counting down and the VM
+	// can be paused or stepped meanwhile
+	key, ok := vm.waitKey()
+	if !ok {
+		vm.pc -= 2
+		return nil
+	}
+	vm.setRegister(in.X, key)
+	return nil
+}
+
+func opFX15(vm *VM, in Instruction) error {
+	// Set delay timer to value in vx
+	vm.delayTimer = vm.variables[in.X]
+	return nil
+}
+
+func opFX18(vm *VM, in Instruction) error {
+	// Set sound timer to value in vx
+	vm.setSoundTimer(vm.variables[in.X])
+	return nil
+}
+
+func opFX1E(vm *VM, in Instruction) error {
+	// Add the value in vx to the index register
+	vm.index += uint16(vm.variables[in.X])
+	return nil
+}
+
+func opFX29(vm *VM, in Instruction) error {
+	// Font character
+	return ErrNotImplemented
+}
+
+func opFX33(vm *VM, in Instruction) error {
+	// Binary-coded decimal conversion, get the value in vx and convert to 3 decimal digits (eg.
+	// 156 -> 1, 5, 6) and store in memory (addresses determined by index register)
+	if err := vm.checkWrite(vm.index, 3); err != nil {
+		return err
+	}
+	dec := vm.variables[in.X]
+	vm.memory[vm.index] = dec / 100
+	vm.memory[vm.index+1] = dec / 10 % 10
+	vm.memory[vm.index+2] = dec % 10
+	return nil
+}
+
+func opFX55(vm *VM, in Instruction) error {
+	// Save the values in registers v0..vx into memory (addresses determined by index register)
+	if err := vm.checkWrite(vm.index, int(in.X)+1); err != nil {
+		return err
+	}
+	for i := uint16(0); i <= in.X; i++ {
+		vm.memory[vm.index+i] = vm.variables[i]
+	}
+	vm.loadStoreQuirk(in.X)
+	return nil
+}
+
+func opFX65(vm *VM, in Instruction) error {
+	// Load values from memory (addresses determined by index register) into registers v0..vx
+	if err := vm.checkMemory(vm.index, int(in.X)+1); err != nil {
+		return err
+	}
+	for i := uint16(0); i <= in.X; i++ {
+		vm.setRegister(i, vm.memory[vm.index+i])
+	}
+	vm.loadStoreQuirk(in.X)
+	return nil
+}
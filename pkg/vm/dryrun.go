@@ -0,0 +1,56 @@
+package vm
+
+// DrawEvent describes where a DXYN instruction would draw its sprite, reported instead of drawing
+// it by WithDrawDryRun
+type DrawEvent struct {
+	// Address of the instruction, and the coordinates of the sprite's top left corner after
+	// wrapping them to the screen
+	PC   uint16
+	X, Y int
+	// The sprite's lit pixels
+	Pixels []SpritePixel
+}
+
+// SpritePixel is a lit pixel of a sprite and where it lands on the screen
+type SpritePixel struct {
+	// Plane is the XO-CHIP plane the pixel belongs to, 1 or 2
+	Plane uint8
+	// Position on the screen before any wrapping, which may be past the right or bottom edge
+	X, Y int
+	// Where it's drawn, if it isn't clipped. Pixels past the edge of the screen are drawn at the
+	// opposite edge with the SpriteWrap quirk, and clipped (not drawn) without it
+	ScreenX, ScreenY int
+	Wrapped, Clipped bool
+}
+
+// drawEvent works out where drawSprite would draw the sprite, for the dry run
+func (vm *VM) drawEvent(xcoord, ycoord uint8, rows, width int) DrawEvent {
+	e := DrawEvent{PC: vm.pc - 2, X: int(xcoord), Y: int(ycoord)}
+	addr := int(vm.index)
+	rowBytes := width / 8
+	for plane := uint8(1); plane <= 2; plane <<= 1 {
+		if vm.selectedPlane&plane == 0 {
+			continue
+		}
+		for y := 0; y < rows; y++ {
+			for x := 0; x < width; x++ {
+				if !spriteBit(vm.memory[addr+y*rowBytes+x/8], x%8) {
+					continue
+				}
+				p := SpritePixel{Plane: plane, X: int(xcoord) + x, Y: int(ycoord) + y}
+				p.ScreenX, p.ScreenY = p.X, p.Y
+				if p.X >= len(vm.pixels) || p.Y >= vm.screenHeight() {
+					if vm.quirks.SpriteWrap {
+						p.Wrapped = true
+						p.ScreenX, p.ScreenY = p.X%len(vm.pixels), p.Y%vm.screenHeight()
+					} else {
+						p.Clipped = true
+					}
+				}
+				e.Pixels = append(e.Pixels, p)
+			}
+		}
+		addr += rows * rowBytes
+	}
+	return e
+}
@@ -0,0 +1,33 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons an instruction can't be executed, wrapped in an ExecError
+var (
+	ErrUnknownOpcode     = errors.New("unknown opcode")
+	ErrNotImplemented    = errors.New("opcode not implemented")
+	ErrStackOverflow     = errors.New("stack overflow")
+	ErrStackUnderflow    = errors.New("return with an empty stack")
+	ErrMemoryOutOfBounds = errors.New("memory access out of bounds")
+	ErrReservedMemory    = errors.New("write to reserved memory")
+	ErrRandomSource      = errors.New("can't read the random source")
+)
+
+// ExecError is returned when an instruction can't be executed, e.g. because the ROM is malformed.
+// The VM is left on the instruction, unchanged
+type ExecError struct {
+	PC     uint16
+	Opcode uint16
+	Err    error
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("executing %04X at %#04x: %v", e.Opcode, e.PC, e.Err)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// MemoryFill is what memory and the V registers hold at power on and after Reset, before a ROM
+// writes to them, see WithMemoryFill. Real hardware doesn't start zeroed, so running a ROM under
+// different fills shows up any reliance on uninitialised state
+type MemoryFill struct {
+	// Byte written everywhere, unless Random is set
+	Value byte
+	// Fill with pseudo-random bytes generated from Seed instead, the same bytes for the same seed
+	Random bool
+	Seed   int64
+}
+
+var (
+	// FillZero zeroes memory and registers, the default
+	FillZero = MemoryFill{}
+	// FillOnes sets every bit of memory and registers, i.e. fills them with 0xFF
+	FillOnes = MemoryFill{Value: 0xFF}
+)
+
+// FillRandom fills memory and registers with pseudo-random bytes from seed
+func FillRandom(seed int64) MemoryFill {
+	return MemoryFill{Random: true, Seed: seed}
+}
+
+// ParseMemoryFill parses a fill in the form produced by String: zero, ones, or random:<seed>
+func ParseMemoryFill(s string) (MemoryFill, error) {
+	switch {
+	case s == "zero":
+		return FillZero, nil
+	case s == "ones":
+		return FillOnes, nil
+	case strings.HasPrefix(s, "random:"):
+		seed, err := strconv.ParseInt(strings.TrimPrefix(s, "random:"), 0, 64)
+		if err != nil {
+			return MemoryFill{}, fmt.Errorf("bad memory fill seed: %w", err)
+		}
+		return FillRandom(seed), nil
+	}
+	return MemoryFill{}, fmt.Errorf("unknown memory fill %q, expected zero, ones or random:<seed>", s)
+}
+
+func (f MemoryFill) String() string {
+	switch {
+	case f.Random:
+		return fmt.Sprintf("random:%d", f.Seed)
+	case f.Value == 0:
+		return "zero"
+	case f.Value == 0xFF:
+		return "ones"
+	}
+	return fmt.Sprintf("%#02x", f.Value)
+}
+
+// fill writes the memory fill over all of memory and the V registers
+func (vm *VM) fill() {
+	next := vm.filler()
+	for i := range vm.memory {
+		vm.memory[i] = next()
+	}
+	for i := range vm.variables {
+		vm.variables[i] = next()
+	}
+}
+
+// fillProgram writes the memory fill over the memory from 0x200 on, where ROMs are loaded,
+// restoring the bytes it held at power on
+func (vm *VM) fillProgram() {
+	next := vm.filler()
+	for i := range vm.memory {
+		if b := next(); i >= 0x200 {
+			vm.memory[i] = b
+		}
+	}
+}
+
+// filler returns a function generating the bytes of the memory fill, from the start of memory
+func (vm *VM) filler() func() byte {
+	if vm.memoryFill.Random {
+		r := rand.New(rand.NewSource(vm.memoryFill.Seed))
+		return func() byte { return byte(r.Uint32()) }
+	}
+	return func() byte { return vm.memoryFill.Value }
+}
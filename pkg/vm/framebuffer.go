@@ -0,0 +1,45 @@
+package vm
+
+import "fmt"
+
+// EncodeFramebuffer packs the display into a compact monochrome bitset, e.g. to send the screen
+// to a remote display. Each row of 64 pixels is 8 bytes, with the leftmost pixel in the most
+// significant bit of the first byte like a sprite row, and the rows follow from the top down:
+// 256 bytes for the standard 64x32 screen, or 512 in HIRES mode. A pixel lit in any XO-CHIP
+// plane is encoded as on
+func (vm *VM) EncodeFramebuffer() []byte {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	rows := vm.screenHeight()
+	data := make([]byte, rows*len(vm.pixels)/8)
+	for y := 0; y < rows; y++ {
+		for x := range vm.pixels {
+			if vm.pixels[x][y] != 0 {
+				data[y*len(vm.pixels)/8+x/8] |= 0x80 >> (x % 8)
+			}
+		}
+	}
+	return data
+}
+
+// DecodeFramebuffer replaces the display with a framebuffer encoded by EncodeFramebuffer, lighting
+// the pixels that are on in plane 1. It's rendered on the next render. data must be the size of
+// the current screen, 256 bytes or 512 in HIRES mode
+func (vm *VM) DecodeFramebuffer(data []byte) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	rows := vm.screenHeight()
+	if len(data) != rows*len(vm.pixels)/8 {
+		return fmt.Errorf("framebuffer is %d bytes, expected %d for %d rows", len(data), rows*len(vm.pixels)/8, rows)
+	}
+	vm.pixels = [64][64]byte{}
+	for y := 0; y < rows; y++ {
+		for x := range vm.pixels {
+			if spriteBit(data[y*len(vm.pixels)/8+x/8], x%8) {
+				vm.pixels[x][y] = 1
+			}
+		}
+	}
+	vm.dirty = true
+	return nil
+}
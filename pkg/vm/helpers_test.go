@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// StateSpec is the expected state of a VM, checked by AssertState. Only the fields that are set
+// are checked
+type StateSpec struct {
+	// Expected values of registers, by register number
+	registers map[int]uint8
+	// Expected bytes in memory, starting at each address
+	memory map[uint16][]byte
+	pc     *uint16
+	index  *uint16
+	// Expected collision flag, i.e. vf
+	collision *bool
+}
+
+// addr returns a pointer to an address, for the pc and index fields of a StateSpec
+func addr(a uint16) *uint16 {
+	return &a
+}
+
+// flagSet returns a pointer to a collision flag, for the collision field of a StateSpec
+func flagSet(set bool) *bool {
+	return &set
+}
+
+// AssertState checks the VM's state against want, reporting every field that differs in a
+// single error
+func AssertState(t *testing.T, vm *VM, want StateSpec) {
+	t.Helper()
+	s := vm.Snapshot()
+	var diffs []string
+	for x, value := range want.registers {
+		if s.variables[x] != value {
+			diffs = append(diffs, fmt.Sprintf("v%X = %#x, want %#x", x, s.variables[x], value))
+		}
+	}
+	for start, values := range want.memory {
+		for i, v := range values {
+			a := int(start) + i
+			if got := s.memory[a]; got != v {
+				diffs = append(diffs, fmt.Sprintf("memory[%#x] = %#x, want %#x", a, got, v))
+			}
+		}
+	}
+	if want.pc != nil && s.pc != *want.pc {
+		diffs = append(diffs, fmt.Sprintf("pc = %#x, want %#x", s.pc, *want.pc))
+	}
+	if want.index != nil && s.index != *want.index {
+		diffs = append(diffs, fmt.Sprintf("index = %#x, want %#x", s.index, *want.index))
+	}
+	if want.collision != nil && (s.variables[0xF] == 1) != *want.collision {
+		diffs = append(diffs, fmt.Sprintf("vf = %d, want collision %v", s.variables[0xF], *want.collision))
+	}
+	if len(diffs) > 0 {
+		t.Errorf("unexpected state:\n\t%s", strings.Join(diffs, "\n\t"))
+	}
+}
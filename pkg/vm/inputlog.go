@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// KeyEvent is a key being pressed or released, as recorded by WithInputLog
+type KeyEvent struct {
+	Key     byte
+	Pressed bool
+	// Number of instructions executed before the event was seen, counted from when the log
+	// was enabled
+	Cycle uint64
+	// Wall-clock time the event was seen
+	Time time.Time
+}
+
+// String formats the event as one line of the log written by WithInputLog
+func (e KeyEvent) String() string {
+	action := "up"
+	if e.Pressed {
+		action = "down"
+	}
+	return fmt.Sprintf("%s cycle %d key %X %s", e.Time.Format("15:04:05.000"), e.Cycle, e.Key, action)
+}
+
+// keyLogger records the transitions of each key of the input
+type keyLogger struct {
+	w      io.Writer
+	cycles uint64
+	keys   [16]bool
+	events []KeyEvent
+}
+
+// poll records any keys that have changed state since the last cycle
+func (l *keyLogger) poll(in Input) {
+	now := time.Now()
+	for key := range l.keys {
+		pressed := in.IsPressed(byte(key))
+		if pressed == l.keys[key] {
+			continue
+		}
+		l.keys[key] = pressed
+		e := KeyEvent{Key: byte(key), Pressed: pressed, Cycle: l.cycles, Time: now}
+		l.events = append(l.events, e)
+		if l.w != nil {
+			fmt.Fprintln(l.w, e)
+		}
+	}
+	l.cycles++
+}
+
+// InputLog returns the key events recorded since the VM was initialised, if enabled with
+// WithInputLog, otherwise nil
+func (vm *VM) InputLog() []KeyEvent {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.keyLog == nil {
+		return nil
+	}
+	return append([]KeyEvent(nil), vm.keyLog.events...)
+}
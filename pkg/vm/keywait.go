@@ -0,0 +1,53 @@
+package vm
+
+import "time"
+
+// keyWait is the progress of an FX0A waiting for a key. FX0A repeats until a key is pressed and
+// released, so the state is carried between passes
+type keyWait struct {
+	// Whether a wait is in progress, and the address of the FX0A waiting, so that a jump away
+	// (e.g. by a debugger) and back starts a new wait
+	active bool
+	pc     uint16
+	// When the wait began
+	started time.Time
+	// Keys held when the wait began, which don't count until they've been released
+	held [16]bool
+	// Keys pressed during the wait, which count once released
+	pressed [16]bool
+}
+
+// waitKey makes one pass of the FX0A at the PC (already advanced past it) waiting for a key,
+// returning the key and true once one has been pressed and released. A key held since before the
+// wait began counts once held for the key repeat delay, if set (see WithKeyRepeat)
+func (vm *VM) waitKey() (byte, bool) {
+	if vm.input == nil {
+		return 0, false
+	}
+	w := &vm.keyWait
+	if !w.active || w.pc != vm.pc-2 {
+		*w = keyWait{active: true, pc: vm.pc - 2, started: time.Now()}
+		for key := range w.held {
+			w.held[key] = vm.input.IsPressed(byte(key))
+		}
+	}
+	repeated := vm.keyRepeat > 0 && time.Since(w.started) >= vm.keyRepeat
+	for key := range w.held {
+		down := vm.input.IsPressed(byte(key))
+		if w.held[key] {
+			if down && repeated {
+				w.active = false
+				return byte(key), true
+			}
+			w.held[key] = down
+			continue
+		}
+		if down {
+			w.pressed[key] = true
+		} else if w.pressed[key] {
+			w.active = false
+			return byte(key), true
+		}
+	}
+	return 0, false
+}
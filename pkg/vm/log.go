@@ -0,0 +1,65 @@
+package vm
+
+// Logger receives the VM's diagnostic messages, see SetLogger. *log.Logger implements it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel is the verbosity of the VM's diagnostic messages, each level including those before it
+type LogLevel int
+
+const (
+	// Failures the VM recovers from, e.g. a trace that can no longer be written
+	LogError LogLevel = iota
+	// Behaviour that may not be what the ROM expects, e.g. quirk warnings
+	LogWarn
+	// Routine events, e.g. a ROM being loaded (the default)
+	LogInfo
+	// Detailed messages, only of use when debugging the VM itself
+	LogDebug
+)
+
+// String returns the prefix messages at the level are logged with
+func (l LogLevel) String() string {
+	switch l {
+	case LogError:
+		return "error"
+	case LogWarn:
+		return "warning"
+	case LogInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+// discardLogger is the default Logger, so that a VM embedded in another program stays quiet
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...interface{}) {}
+
+// SetLogger sets where the VM's diagnostic messages are written. By default they're discarded.
+// Pass nil to discard them again
+func (vm *VM) SetLogger(l Logger) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if l == nil {
+		l = discardLogger{}
+	}
+	vm.logger = l
+}
+
+// SetLogLevel sets the most verbose level of message logged, LogInfo by default
+func (vm *VM) SetLogLevel(level LogLevel) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.logLevel = level
+}
+
+// logf logs a message at level, if the log level includes it
+func (vm *VM) logf(level LogLevel, format string, v ...interface{}) {
+	if level > vm.logLevel || vm.logger == nil {
+		return
+	}
+	vm.logger.Printf(level.String()+": "+format, v...)
+}
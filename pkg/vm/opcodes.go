@@ -0,0 +1,88 @@
+package vm
+
+// OpcodeInfo describes an opcode form the VM can execute
+type OpcodeInfo struct {
+	// Form of the opcode with its operands replaced by X, Y, N, NN or NNN, e.g. "8XY4"
+	Form string
+	// Assembly mnemonic, as produced by Disassemble but with the operands named as in the form,
+	// e.g. "ADD VX, NN" for 7XNN
+	Mnemonic string
+	// What the instruction does
+	Description string
+	// Instruction set that introduced the opcode: "CHIP-8", "HIRES", "SUPER-CHIP" or "XO-CHIP".
+	// HIRES opcodes are only executed in HIRES mode (see WithHires) and XO-CHIP opcodes with
+	// WithXOChip
+	Extension string
+}
+
+// opcodes is the registry of implemented opcodes, to be extended as opcodes are implemented
+var opcodes = []OpcodeInfo{
+	{"00E0", "CLS", "Clear the screen", "CHIP-8"},
+	{"0230", "CLS", "Clear the 64x64 screen", "HIRES"},
+	{"00EE", "RET", "Return from a subroutine", "CHIP-8"},
+	{"00FD", "EXIT", "Exit the interpreter", "SUPER-CHIP"},
+	{"1NNN", "JP NNN", "Jump to NNN", "CHIP-8"},
+	{"2NNN", "CALL NNN", "Call the subroutine at NNN", "CHIP-8"},
+	{"3XNN", "SE VX, NN", "Skip the next instruction if VX == NN", "CHIP-8"},
+	{"4XNN", "SNE VX, NN", "Skip the next instruction if VX != NN", "CHIP-8"},
+	{"5XY0", "SE VX, VY", "Skip the next instruction if VX == VY", "CHIP-8"},
+	{"5XY2", "SAVE VX-VY", "Store VX to VY in memory starting at I", "XO-CHIP"},
+	{"5XY3", "LOAD VX-VY", "Load VX to VY from memory starting at I", "XO-CHIP"},
+	{"6XNN", "LD VX, NN", "Set VX = NN", "CHIP-8"},
+	{"7XNN", "ADD VX, NN", "Set VX = VX + NN, without carry", "CHIP-8"},
+	{"8XY0", "LD VX, VY", "Set VX = VY", "CHIP-8"},
+	{"8XY1", "OR VX, VY", "Set VX = VX OR VY", "CHIP-8"},
+	{"8XY2", "AND VX, VY", "Set VX = VX AND VY", "CHIP-8"},
+	{"8XY3", "XOR VX, VY", "Set VX = VX XOR VY", "CHIP-8"},
+	{"8XY4", "ADD VX, VY", "Set VX = VX + VY", "CHIP-8"},
+	{"8XY5", "SUB VX, VY", "Set VX = VX - VY", "CHIP-8"},
+	{"8XY6", "SHR VX, VY", "Set VX = VY >> 1, VF = the bit shifted out", "CHIP-8"},
+	{"8XY7", "SUBN VX, VY", "Set VX = VY - VX", "CHIP-8"},
+	{"8XYE", "SHL VX, VY", "Set VX = VY << 1, VF = the bit shifted out", "CHIP-8"},
+	{"9XY0", "SNE VX, VY", "Skip the next instruction if VX != VY", "CHIP-8"},
+	{"ANNN", "LD I, NNN", "Set I = NNN", "CHIP-8"},
+	{"BNNN", "JP V0, NNN", "Jump to NNN + V0", "CHIP-8"},
+	{"CXNN", "RND VX, NN", "Set VX = a random byte AND NN", "CHIP-8"},
+	{"DXYN", "DRW VX, VY, N", "Draw the N byte sprite at I at (VX, VY), VF = collision. With XO-CHIP, N = 0 draws a 16x16 sprite", "CHIP-8"},
+	{"EX9E", "SKP VX", "Skip the next instruction if the key in VX is pressed", "CHIP-8"},
+	{"EXA1", "SKNP VX", "Skip the next instruction if the key in VX is not pressed", "CHIP-8"},
+	{"F002", "AUDIO", "Load the 16 byte audio pattern from I", "XO-CHIP"},
+	{"FN01", "PLANE N", "Select the bit planes to draw to", "XO-CHIP"},
+	{"FX07", "LD VX, DT", "Set VX = the delay timer", "CHIP-8"},
+	{"FX0A", "LD VX, K", "Wait for a key press and store it in VX", "CHIP-8"},
+	{"FX15", "LD DT, VX", "Set the delay timer = VX", "CHIP-8"},
+	{"FX18", "LD ST, VX", "Set the sound timer = VX", "CHIP-8"},
+	{"FX1E", "ADD I, VX", "Set I = I + VX", "CHIP-8"},
+	{"FX33", "LD B, VX", "Store the decimal digits of VX at I, I+1 and I+2", "CHIP-8"},
+	{"FX3A", "PITCH VX", "Set the audio pattern's pitch = VX", "XO-CHIP"},
+	{"FX55", "LD [I], VX", "Store V0 to VX in memory starting at I", "CHIP-8"},
+	{"FX65", "LD VX, [I]", "Load V0 to VX from memory starting at I", "CHIP-8"},
+}
+
+// opcodesByForm indexes the registry by form
+var opcodesByForm = func() map[string]OpcodeInfo {
+	byForm := make(map[string]OpcodeInfo, len(opcodes))
+	for _, info := range opcodes {
+		byForm[info.Form] = info
+	}
+	return byForm
+}()
+
+// supported reports whether opcode is in the registry, and the extension it belongs to is enabled
+func (vm *VM) supported(opcode uint16) bool {
+	info, ok := opcodesByForm[opcodeForm(opcode)]
+	switch {
+	case !ok:
+		return false
+	case info.Extension == "XO-CHIP":
+		return vm.xoChip
+	case info.Extension == "HIRES":
+		return vm.hires
+	}
+	return true
+}
+
+// SupportedOpcodes returns the opcode forms the VM can execute, in opcode order
+func SupportedOpcodes() []OpcodeInfo {
+	return append([]OpcodeInfo(nil), opcodes...)
+}
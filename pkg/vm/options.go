@@ -0,0 +1,361 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Option configures optional behaviour of the VM, passed to Init
+type Option func(*VM)
+
+// WithPauseOnBlur automatically pauses the VM while the display window doesn't have focus, and
+// resumes it once focus returns
+func WithPauseOnBlur(enabled bool) Option {
+	return func(vm *VM) {
+		vm.pauseOnBlur = enabled
+	}
+}
+
+// WithStartPaused leaves the VM paused when Run is called, so nothing executes until Resume or
+// Step is called. Useful for debugging from the very first instruction
+func WithStartPaused(enabled bool) Option {
+	return func(vm *VM) {
+		vm.paused = enabled
+	}
+}
+
+// WithStartDelayFrames makes Run wait for frames 60Hz frames, rendering the (usually blank) screen
+// each frame, before starting the ROM. This gives graphics and audio backends that stutter as they
+// warm up time to settle, so a ROM's title screen doesn't miss the first key presses. Off (0) by
+// default
+func WithStartDelayFrames(frames int) Option {
+	return func(vm *VM) {
+		vm.startDelayFrames = frames
+	}
+}
+
+// WithDrawThrottle coalesces draws so the display is rendered at most once per 60Hz frame, no
+// matter how many DXYN instructions ran. The display buffer itself is still updated immediately
+func WithDrawThrottle(enabled bool) Option {
+	return func(vm *VM) {
+		vm.drawThrottle = enabled
+	}
+}
+
+// WithXOChip enables the XO-CHIP extensions to the instruction set
+func WithXOChip(enabled bool) Option {
+	return func(vm *VM) {
+		vm.xoChip = enabled
+	}
+}
+
+// WithHandler makes the VM execute opcodes of form (e.g. "00FB", as given by OpcodeInfo.Form) with
+// h, in place of the built in handler if there is one. This is how instruction set extensions
+// add opcodes. The form must also be in the opcode registry for WithStrictOpcodes to accept it
+func WithHandler(form string, h Handler) Option {
+	return func(vm *VM) {
+		if vm.handlers == nil {
+			vm.handlers = map[string]Handler{}
+		}
+		vm.handlers[form] = h
+	}
+}
+
+// WithHires sets when to run ROMs in the 64x64 HIRES mode used by a handful of COSMAC VIP programs
+// (see HiresMode), which is checked as each ROM is loaded. In HIRES mode DXYN's y coordinate wraps
+// at 64 rather than 32, and 0230 clears the screen
+func WithHires(mode HiresMode) Option {
+	return func(vm *VM) {
+		vm.hiresMode = mode
+	}
+}
+
+// WithRandomFunc sets the source of random bytes used by CXNN, e.g. a fixed sequence for tests
+func WithRandomFunc(fn func() byte) Option {
+	return func(vm *VM) {
+		vm.random = func() (byte, error) {
+			return fn(), nil
+		}
+	}
+}
+
+// WithRandomSource reads the random bytes used by CXNN from r, e.g. crypto/rand.Reader. If r
+// can't be read, e.g. because it has run out, CXNN fails with ErrRandomSource
+func WithRandomSource(r io.Reader) Option {
+	return func(vm *VM) {
+		vm.random = func() (byte, error) {
+			var b [1]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return 0, fmt.Errorf("%w: %v", ErrRandomSource, err)
+			}
+			return b[0], nil
+		}
+	}
+}
+
+// WithClockSpeed sets the number of cycles Run executes per second, 700 by default
+func WithClockSpeed(hz int) Option {
+	return func(vm *VM) {
+		vm.clockSpeed = hz
+	}
+}
+
+// WithDrawCycleCost charges each DXYN n extra cycles, during which the run loop executes nothing,
+// as drawing was relatively slow on real hardware and some timing sensitive ROMs depend on it. The
+// cycles count towards the clock speed and cycles per frame like any other. 0 by default, i.e.
+// drawing is free. Step isn't affected
+func WithDrawCycleCost(n int) Option {
+	return func(vm *VM) {
+		vm.drawCycleCost = n
+	}
+}
+
+// WithCyclesPerFrame runs exactly n cycles per 60Hz frame, ticking the timers and rendering once
+// at the end of each frame, rather than pacing cycles by the clock speed. Pass 0 to disable
+func WithCyclesPerFrame(n int) Option {
+	return func(vm *VM) {
+		vm.cyclesPerFrame = n
+	}
+}
+
+// WithQuirks sets the interpreter behaviours to emulate, see Quirks
+func WithQuirks(q Quirks) Option {
+	return func(vm *VM) {
+		vm.quirks = q
+	}
+}
+
+// WithQuirkWarnings logs (at LogWarn, see SetLogger) the first time each instruction whose
+// behaviour depends on a quirk is executed, to help work out which quirks a ROM needs
+func WithQuirkWarnings(enabled bool) Option {
+	return func(vm *VM) {
+		vm.quirkWarnings = enabled
+	}
+}
+
+// WithKeyRepeat makes FX0A take a key held since before it began once it has been held for
+// delay, like keyboard auto-repeat, rather than waiting for it to be released and pressed again.
+// By default (0) each FX0A needs a fresh press, so a single press can't satisfy two key waits
+func WithKeyRepeat(delay time.Duration) Option {
+	return func(vm *VM) {
+		vm.keyRepeat = delay
+	}
+}
+
+// WithInput sets where key presses are read from, e.g. the display window or a keypad.Keypad
+// driven from code
+func WithInput(in Input) Option {
+	return func(vm *VM) {
+		vm.input = in
+	}
+}
+
+// WithAudio sets the backend that plays the beep while the sound timer is running, e.g.
+// audio.Bell. Without one the VM is silent, apart from any sound hook
+func WithAudio(a AudioBeeper) Option {
+	return func(vm *VM) {
+		vm.audio = a
+	}
+}
+
+// WithDelayTimer starts the VM with the delay timer set to value rather than 0, e.g. to test
+// ROM code that polls it with FX07
+func WithDelayTimer(value uint8) Option {
+	return func(vm *VM) {
+		vm.delayTimer = value
+	}
+}
+
+// WithSoundTimer starts the VM with the sound timer set to value rather than 0. The beep starts,
+// as if set by FX18, when the VM starts running, so it reaches the sound hook and audio backend
+// and lasts at least the minimum beep duration
+func WithSoundTimer(value uint8) Option {
+	return func(vm *VM) {
+		vm.soundTimer = value
+		vm.soundPreset = true
+	}
+}
+
+// WithAudioSamples generates the beep as samples at rate per second, e.g. 44100, for an audio
+// backend that implements AudioSampler, e.g. to record it. Each 60Hz tick of the sound timer
+// produces 1/60 of a second of samples, so the audio lasts exactly as long as the timer runs.
+// Off (0) by default
+func WithAudioSamples(rate int) Option {
+	return func(vm *VM) {
+		vm.sampleRate = rate
+	}
+}
+
+// WithMinSoundDuration makes every beep last at least d, rounded up to whole 60Hz timer ticks,
+// even if the ROM sets the sound timer to only 1 or 2. Off (0) by default
+func WithMinSoundDuration(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.minSoundTicks = int((d*timerFrequency + time.Second - 1) / time.Second)
+	}
+}
+
+// WithCoverage records which opcode forms are executed, see CoverageReport
+func WithCoverage(enabled bool) Option {
+	return func(vm *VM) {
+		if enabled {
+			vm.coverage = map[string]bool{}
+		} else {
+			vm.coverage = nil
+		}
+	}
+}
+
+// WithCollisionLog records every DXYN that collides, for CollisionEvents. Off by default
+func WithCollisionLog(enabled bool) Option {
+	return func(vm *VM) {
+		vm.logCollisions = enabled
+	}
+}
+
+// WithInputLog records each key press and release, with the cycle and time it was seen, to help
+// diagnose stuck or missed keys. The input is checked before every instruction. Events are kept
+// for InputLog and, unless w is nil, also written to w as they happen, one per line
+func WithInputLog(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.keyLog = &keyLogger{w: w}
+	}
+}
+
+// WithStrictOpcodes checks each opcode against the registry of supported opcodes (see
+// SupportedOpcodes) before executing it, and stops with an ExecError wrapping ErrUnknownOpcode
+// for any that isn't listed or belongs to an extension that isn't enabled. Without it a few
+// unsupported forms, such as 0NNN machine code routines and 8XY8, are silently ignored. Useful
+// for running untrusted ROMs, or finding out exactly where a ROM goes beyond what's supported
+func WithStrictOpcodes(enabled bool) Option {
+	return func(vm *VM) {
+		vm.strictOpcodes = enabled
+	}
+}
+
+// WithDrawDryRun makes DXYN report where its sprite would be drawn to fn, including which pixels
+// would wrap round or be clipped at the edges of the screen under the current quirks, instead of
+// drawing it. The screen and vf are left unchanged. It shows the effect of the SpriteWrap quirk,
+// e.g. to find out why a ROM draws garbage at the edge of the screen. Pass nil to draw as usual
+func WithDrawDryRun(fn func(DrawEvent)) Option {
+	return func(vm *VM) {
+		vm.drawDryRun = fn
+	}
+}
+
+// WithIgnoreUnknown00NN ignores 00NN opcodes that aren't implemented, such as the extra
+// instructions of SUPER-CHIP derivatives, logging the first use of each at LogWarn, rather than
+// stopping with an ExecError wrapping ErrUnknownOpcode. Other 0NNN machine code routines are
+// always ignored
+func WithIgnoreUnknown00NN(enabled bool) Option {
+	return func(vm *VM) {
+		vm.ignoreUnknown00NN = enabled
+	}
+}
+
+// WithIgnoreUnknownFXNN ignores FXNN opcodes that aren't implemented, such as the SUPER-CHIP
+// FX30, FX75 and FX85, logging the first use of each at LogWarn, rather than stopping with an
+// ExecError wrapping ErrUnknownOpcode. Useful to find which extensions a ROM uses in one run
+func WithIgnoreUnknownFXNN(enabled bool) Option {
+	return func(vm *VM) {
+		vm.ignoreUnknownFXNN = enabled
+	}
+}
+
+// WithPauseOnUnimplemented pauses the VM, with the PC left on the instruction, when the run loop
+// reaches an unknown or unimplemented opcode, rather than stopping Run with an error. The state
+// can then be inspected in a debugger before skipping the instruction (see Skip) and resuming, or
+// giving up. Stepping onto the opcode while paused still returns the error
+func WithPauseOnUnimplemented(enabled bool) Option {
+	return func(vm *VM) {
+		vm.pauseOnUnimplemented = enabled
+	}
+}
+
+// WithFrameStats records how many instructions are executed between each render, see
+// InstructionsPerFrameStats
+func WithFrameStats(enabled bool) Option {
+	return func(vm *VM) {
+		if enabled {
+			vm.frameStats = map[int]int{}
+		} else {
+			vm.frameStats = nil
+		}
+		vm.sinceRender = 0
+	}
+}
+
+// WithPanicRecovery makes Run return an error identifying the instruction being executed, rather
+// than crashing, if executing a cycle panics. Off by default, so that developers get the raw panic
+// and its stack trace
+func WithPanicRecovery(enabled bool) Option {
+	return func(vm *VM) {
+		vm.recoverPanics = enabled
+	}
+}
+
+// WithTrace makes Run and RunCycles write a trace of every instruction they execute to w, one
+// JSON TraceStep per line, which VerifyTrace can replay to check another VM reaches the same
+// states
+func WithTrace(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.tracer = &tracer{enc: json.NewEncoder(w)}
+	}
+}
+
+// WithHistory keeps the state from before each of the last depth instructions executed, so that
+// StepBack can undo them. Off (0) by default, and a negative depth is treated as 0. Each
+// instruction of history costs around 8KB, allocated up front
+func WithHistory(depth int) Option {
+	return func(vm *VM) {
+		if depth < 0 {
+			depth = 0
+		}
+		vm.historyDepth = depth
+		vm.history = make([]Snapshot, depth)
+		vm.historyHead, vm.historyLen = 0, 0
+	}
+}
+
+// WithMemoryFill sets what memory and the V registers hold at power on and after Reset, zeroes
+// by default
+func WithMemoryFill(f MemoryFill) Option {
+	return func(vm *VM) {
+		vm.memoryFill = f
+	}
+}
+
+// WithKeepMemoryOnLoad makes LoadROM, LoadROMURL and LoadROMBytes write the ROM over memory as it
+// is, rather than first clearing the memory from 0x200 on. Any data put there with LoadROMAt
+// beforehand is then kept, along with anything left by the previous ROM
+func WithKeepMemoryOnLoad(enabled bool) Option {
+	return func(vm *VM) {
+		vm.keepMemoryOnLoad = enabled
+	}
+}
+
+// WithPCPolicy sets what to do when the PC runs past the end of memory, PCError by default
+func WithPCPolicy(p PCPolicy) Option {
+	return func(vm *VM) {
+		vm.pcPolicy = p
+	}
+}
+
+// WithProtectReservedMemory sets what to do when FX33, FX55 or 5XY2 write to the memory below
+// 0x200 reserved for the interpreter, where a ROM writing is usually a bug, e.g. the index register
+// not having been set. ProtectOff by default
+func WithProtectReservedMemory(p MemoryProtection) Option {
+	return func(vm *VM) {
+		vm.protectReserved = p
+	}
+}
+
+// WithBeepOnCollision calls beep, which should play a tone distinct from the sound timer's,
+// whenever DXYN draws a sprite that collides (sets vf to 1), to make collisions audible when
+// debugging. Pass nil (the default) to disable it
+func WithBeepOnCollision(beep func()) Option {
+	return func(vm *VM) {
+		vm.collisionBeep = beep
+	}
+}
@@ -0,0 +1,35 @@
+package vm
+
+// Quirks toggles behaviours that differ between CHIP-8 interpreters, which ROMs written for one
+// interpreter may depend on. The zero value is this emulator's default behaviour
+type Quirks struct {
+	// 8XY6/8XYE shift vx in place rather than shifting vy into vx (CHIP-48, SUPER-CHIP)
+	ShiftInPlace bool `json:"shift_in_place"`
+	// BNNN jumps to XNN + vx rather than NNN + v0 (CHIP-48, SUPER-CHIP)
+	JumpWithVX bool `json:"jump_with_vx"`
+	// FX55/FX65 increment the index register past the last address accessed (COSMAC VIP)
+	LoadStoreIncrementsIndex bool `json:"load_store_increments_index"`
+	// 8XY1/8XY2/8XY3 reset vf to 0 (COSMAC VIP)
+	LogicResetsVF bool `json:"logic_resets_vf"`
+	// 00E0 also resets vf to 0, clearing the collision flag along with the screen. No original
+	// interpreter did this, but some homebrew ROMs rely on it for per-frame collision checks
+	ClearResetsVF bool `json:"clear_resets_vf"`
+	// DXYN wraps the parts of a sprite that go past the edge of the screen round to the opposite
+	// edge, rather than clipping them (XO-CHIP). Original CHIP-8 and SUPER-CHIP clip, and some
+	// ROMs depend on it, e.g. BLITZ draws garbage at the top of the screen when sprites wrap.
+	// Some XO-CHIP games written with Octo, which wraps by default, need wrapping instead
+	SpriteWrap bool `json:"sprite_wrap"`
+}
+
+// warnQuirk logs the first time an instruction whose behaviour depends on the named quirk is
+// executed, if quirk warnings are enabled
+func (vm *VM) warnQuirk(quirk string, enabled bool) {
+	if !vm.quirkWarnings || vm.quirksWarned[quirk] {
+		return
+	}
+	if vm.quirksWarned == nil {
+		vm.quirksWarned = map[string]bool{}
+	}
+	vm.quirksWarned[quirk] = true
+	vm.logf(LogWarn, "quirk: %04X at %#x depends on the %s quirk, which is %v", vm.opcode, vm.pc-2, quirk, enabled)
+}
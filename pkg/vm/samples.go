@@ -0,0 +1,45 @@
+package vm
+
+import "math"
+
+// AudioSampler is implemented by audio backends that play buffers of samples, generated by the
+// VM when WithAudioSamples is set, rather than a tone of their own between Start and Stop
+type AudioSampler interface {
+	// PlaySamples queues samples, from -1 to 1, at the sample rate set by WithAudioSamples
+	PlaySamples(samples []float32)
+}
+
+// playSamples generates the samples for one 60Hz timer tick of the beep, and gives them to the
+// audio backend if it takes samples. A beep of n ticks is exactly n/60 seconds of samples, with
+// any fraction of a sample carried over to the next tick. With XO-CHIP the audio pattern is
+// looped at its pitch, otherwise it's a square wave at beepFrequency
+func (vm *VM) playSamples() {
+	s, ok := vm.audio.(AudioSampler)
+	if !ok || vm.sampleRate <= 0 {
+		return
+	}
+	vm.sampleDebt += float64(vm.sampleRate) / timerFrequency
+	n := int(vm.sampleDebt)
+	vm.sampleDebt -= float64(n)
+
+	samples := make([]float32, n)
+	pattern, rate := vm.audioPattern, vm.patternRate()
+	for i := range samples {
+		var on bool
+		if vm.xoChip {
+			// The phase counts bits of the pattern
+			bit := int(vm.samplePhase) % (8 * len(pattern))
+			on = pattern[bit/8]&(0x80>>(bit%8)) != 0
+			vm.samplePhase = math.Mod(vm.samplePhase+rate/float64(vm.sampleRate), float64(8*len(pattern)))
+		} else {
+			// The phase counts cycles of the square wave
+			on = vm.samplePhase < 0.5
+			vm.samplePhase = math.Mod(vm.samplePhase+beepFrequency/float64(vm.sampleRate), 1)
+		}
+		samples[i] = -1
+		if on {
+			samples[i] = 1
+		}
+	}
+	s.PlaySamples(samples)
+}
@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version of the save state format written by SaveState
+const saveStateVersion = 1
+
+// savedState is the JSON form of a Snapshot written by SaveState. Memory and the display are
+// written as byte slices, which JSON encodes compactly in base64
+type savedState struct {
+	Version       int      `json:"version"`
+	Opcode        uint16   `json:"opcode"`
+	Memory        []byte   `json:"memory"`
+	PC            uint16   `json:"pc"`
+	Index         uint16   `json:"index"`
+	Stack         []uint16 `json:"stack"`
+	SP            uint16   `json:"sp"`
+	DelayTimer    uint8    `json:"delay_timer"`
+	SoundTimer    uint8    `json:"sound_timer"`
+	SoundHold     int      `json:"sound_hold"`
+	Variables     []byte   `json:"variables"`
+	Pixels        []byte   `json:"pixels"`
+	Hires         bool     `json:"hires"`
+	SelectedPlane uint8    `json:"selected_plane"`
+	AudioPattern  []byte   `json:"audio_pattern"`
+	Pitch         uint8    `json:"pitch"`
+	ROMSize       int      `json:"rom_size"`
+	ROMHash       string   `json:"rom_hash"`
+	ROMName       string   `json:"rom_name"`
+}
+
+// SaveState writes the state of the emulated machine to w, including the loaded ROM, so that
+// LoadState can carry on from the same point later, e.g. in another run of the emulator
+func (vm *VM) SaveState(w io.Writer) error {
+	s := vm.Snapshot()
+	saved := savedState{
+		Version:       saveStateVersion,
+		Opcode:        s.opcode,
+		Memory:        s.memory[:],
+		PC:            s.pc,
+		Index:         s.index,
+		Stack:         s.stack[:],
+		SP:            s.sp,
+		DelayTimer:    s.delayTimer,
+		SoundTimer:    s.soundTimer,
+		SoundHold:     s.soundHold,
+		Variables:     s.variables[:],
+		Hires:         s.hires,
+		SelectedPlane: s.selectedPlane,
+		AudioPattern:  s.audioPattern[:],
+		Pitch:         s.pitch,
+		ROMSize:       s.romSize,
+		ROMHash:       s.romHash,
+		ROMName:       s.romName,
+	}
+	for x := range s.pixels {
+		saved.Pixels = append(saved.Pixels, s.pixels[x][:]...)
+	}
+	return json.NewEncoder(w).Encode(saved)
+}
+
+// LoadState restores the emulated machine to a state written by SaveState, replacing the loaded
+// ROM with the one saved with it. The VM is left unchanged if the state can't be read
+func (vm *VM) LoadState(r io.Reader) error {
+	var saved savedState
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return fmt.Errorf("reading save state: %w", err)
+	}
+	if saved.Version != saveStateVersion {
+		return fmt.Errorf("unsupported save state version %d", saved.Version)
+	}
+	var s Snapshot
+	if len(saved.Memory) != len(s.memory) || len(saved.Stack) != len(s.stack) ||
+		len(saved.Variables) != len(s.variables) || len(saved.Pixels) != len(s.pixels)*len(s.pixels[0]) ||
+		len(saved.AudioPattern) != len(s.audioPattern) {
+		return fmt.Errorf("save state is malformed")
+	}
+	// Instructions rely on the stack pointer and PC being in range. The index is checked where
+	// it's used, as FX1E can legitimately move it past the end of memory
+	if int(saved.SP) >= len(s.stack) || int(saved.PC) >= len(s.memory) {
+		return fmt.Errorf("save state is malformed: sp %d, pc %#04x out of range", saved.SP, saved.PC)
+	}
+	// The disassembler reads the ROM's bytes from memory, a negative beep hold would never run out
+	// and DXYN draws to the planes selected by FN01
+	if saved.ROMSize < 0 || saved.ROMSize > MaxROMSize {
+		return fmt.Errorf("save state is malformed: rom size %d out of range", saved.ROMSize)
+	}
+	if saved.SoundHold < 0 {
+		return fmt.Errorf("save state is malformed: sound hold %d is negative", saved.SoundHold)
+	}
+	if saved.SelectedPlane > 3 {
+		return fmt.Errorf("save state is malformed: selected plane %d out of range", saved.SelectedPlane)
+	}
+	s.opcode = saved.Opcode
+	copy(s.memory[:], saved.Memory)
+	s.pc = saved.PC
+	s.index = saved.Index
+	copy(s.stack[:], saved.Stack)
+	s.sp = saved.SP
+	s.delayTimer = saved.DelayTimer
+	s.soundTimer = saved.SoundTimer
+	s.soundHold = saved.SoundHold
+	copy(s.variables[:], saved.Variables)
+	for x := range s.pixels {
+		copy(s.pixels[x][:], saved.Pixels[x*len(s.pixels[x]):])
+	}
+	s.hires = saved.Hires
+	s.selectedPlane = saved.SelectedPlane
+	copy(s.audioPattern[:], saved.AudioPattern)
+	s.pitch = saved.Pitch
+	s.romSize = saved.ROMSize
+	s.romHash = saved.ROMHash
+	s.romName = saved.ROMName
+	vm.Restore(s)
+	return nil
+}
@@ -0,0 +1,210 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Register returns the value of variable register vi, where i is in the range [0-F]
+func (vm *VM) Register(i int) (uint8, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if i < 0 || i >= len(vm.variables) {
+		return 0, fmt.Errorf("register index %d out of range [0-15]", i)
+	}
+	return vm.variables[i], nil
+}
+
+// SetRegister sets variable register vi to v, where i is in the range [0-F]
+func (vm *VM) SetRegister(i int, v uint8) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if i < 0 || i >= len(vm.variables) {
+		return fmt.Errorf("register index %d out of range [0-15]", i)
+	}
+	vm.variables[i] = v
+	return nil
+}
+
+// Index returns the value of the index register
+func (vm *VM) Index() uint16 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.index
+}
+
+// SetIndex sets the index register
+func (vm *VM) SetIndex(i uint16) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.index = i
+}
+
+// PC returns the address of the next instruction to be executed
+func (vm *VM) PC() uint16 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.pc
+}
+
+// SetPC sets the address of the next instruction to be executed
+func (vm *VM) SetPC(pc uint16) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.pc = pc
+}
+
+// Snapshot is a copy of the state of the emulated machine at a point in time, see VM.Snapshot
+type Snapshot struct {
+	opcode        uint16
+	memory        [4096]byte
+	pc            uint16
+	index         uint16
+	stack         [16]uint16
+	sp            uint16
+	delayTimer    uint8
+	soundTimer    uint8
+	soundHold     int
+	variables     [16]uint8
+	pixels        [64][64]byte
+	hires         bool
+	selectedPlane uint8
+	audioPattern  [16]byte
+	pitch         uint8
+	romSize       int
+	romHash       string
+	romName       string
+}
+
+// Snapshot returns a copy of the state of the emulated machine, which Restore can return it to
+func (vm *VM) Snapshot() Snapshot {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.snapshot()
+}
+
+// Restore returns the emulated machine to the state in s, redrawing the display on the next render
+func (vm *VM) Restore(s Snapshot) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.restore(&s)
+}
+
+func (vm *VM) snapshot() Snapshot {
+	return Snapshot{
+		opcode:        vm.opcode,
+		memory:        vm.memory,
+		pc:            vm.pc,
+		index:         vm.index,
+		stack:         vm.stack,
+		sp:            vm.sp,
+		delayTimer:    vm.delayTimer,
+		soundTimer:    vm.soundTimer,
+		soundHold:     vm.soundHold,
+		variables:     vm.variables,
+		pixels:        vm.pixels,
+		hires:         vm.hires,
+		selectedPlane: vm.selectedPlane,
+		audioPattern:  vm.audioPattern,
+		pitch:         vm.pitch,
+		romSize:       vm.romSize,
+		romHash:       vm.romHash,
+		romName:       vm.romName,
+	}
+}
+
+// restore sets the emulated machine's state to s, starting or stopping the beep if the restored
+// sound timer calls for it
+func (vm *VM) restore(s *Snapshot) {
+	wasActive := vm.sounding()
+	vm.opcode = s.opcode
+	vm.memory = s.memory
+	vm.pc = s.pc
+	vm.index = s.index
+	vm.stack = s.stack
+	vm.sp = s.sp
+	vm.delayTimer = s.delayTimer
+	vm.soundTimer = s.soundTimer
+	vm.soundHold = s.soundHold
+	vm.variables = s.variables
+	vm.pixels = s.pixels
+	vm.hires = s.hires
+	vm.selectedPlane = s.selectedPlane
+	vm.audioPattern = s.audioPattern
+	vm.pitch = s.pitch
+	vm.romSize = s.romSize
+	vm.romHash = s.romHash
+	vm.romName = s.romName
+	// Any key wait starts afresh
+	vm.keyWait = keyWait{}
+	vm.dirty = true
+	if active := vm.sounding(); active != wasActive && !vm.paused {
+		vm.beep(active)
+	}
+}
+
+// Reset returns the emulated machine to its power-on state, with memory and registers filled as
+// set by WithMemoryFill (zeroed by default) and a blank screen, ready for a new ROM to be loaded.
+// Options, hooks, the renderer and input are kept
+func (vm *VM) Reset() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.restore(&Snapshot{pc: 0x200, selectedPlane: 1, pitch: 64})
+	vm.fill()
+	vm.historyHead, vm.historyLen = 0, 0
+	vm.stopErr = nil
+	vm.stall = 0
+	vm.soundPreset = false
+	vm.uptime, vm.totalCycles = 0, 0
+	vm.collisions = nil
+	if !vm.runningSince.IsZero() {
+		vm.runningSince = time.Now()
+	}
+}
+
+// CopyStateFrom makes vm a copy of other's emulated machine: memory, registers, timers, stack,
+// display and XO-CHIP plane and audio state. Everything is copied by value, so the two VMs can
+// then run independently, e.g. to experiment from a snapshot of a running VM without disturbing
+// it.
+//
+// vm keeps its own renderer, input, hooks, options and random number source, so it draws to its
+// own display and doesn't consume random numbers from other's source. The display is redrawn on
+// vm's next render
+func (vm *VM) CopyStateFrom(other *VM) {
+	if vm == other {
+		return
+	}
+	other.mu.Lock()
+	s := other.snapshot()
+	other.mu.Unlock()
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.restore(&s)
+}
+
+// StepBack undoes the last instruction executed, restoring the state from before it. Up to the
+// number of instructions set by WithHistory can be undone, after which (or if history is disabled)
+// it returns an error and leaves the state unchanged
+func (vm *VM) StepBack() error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.historyLen == 0 {
+		return errors.New("no instruction history to step back through")
+	}
+	vm.historyHead = (vm.historyHead + vm.historyDepth - 1) % vm.historyDepth
+	vm.historyLen--
+	vm.restore(&vm.history[vm.historyHead])
+	return nil
+}
+
+// recordHistory saves the state before an instruction is executed so StepBack can undo it,
+// overwriting the oldest state once the history is full
+func (vm *VM) recordHistory() {
+	vm.history[vm.historyHead] = vm.snapshot()
+	vm.historyHead = (vm.historyHead + 1) % vm.historyDepth
+	if vm.historyLen < vm.historyDepth {
+		vm.historyLen++
+	}
+}
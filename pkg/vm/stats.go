@@ -0,0 +1,24 @@
+package vm
+
+// InstructionsPerFrameStats returns a histogram of the number of instructions executed between
+// consecutive renders: for each instruction count, the number of frames rendered after that many
+// instructions. A steady ROM has one tall bar, a bursty one (e.g. drawing everything in some
+// frames and nothing in others) a wide spread. It returns nil unless enabled with WithFrameStats
+func (vm *VM) InstructionsPerFrameStats() map[int]int {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.frameStats == nil {
+		return nil
+	}
+	stats := make(map[int]int, len(vm.frameStats))
+	for n, frames := range vm.frameStats {
+		stats[n] = frames
+	}
+	return stats
+}
+
+// recordFrameStats adds the instructions executed since the last render to the histogram
+func (vm *VM) recordFrameStats() {
+	vm.frameStats[vm.sinceRender]++
+	vm.sinceRender = 0
+}
@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// TraceStep is one line of a trace written by WithTrace: a JSON object describing a single
+// executed instruction and the state it changed
+type TraceStep struct {
+	// Number of instructions executed before this one
+	Cycle int `json:"cycle"`
+	// Address and opcode of the instruction
+	PC     uint16 `json:"pc"`
+	Opcode uint16 `json:"opcode"`
+	// Timer values the instruction ran with. Timers count down in real time, so these are
+	// restored rather than checked when verifying
+	DelayTimer uint8 `json:"delay_timer"`
+	SoundTimer uint8 `json:"sound_timer"`
+	// New values of the registers (by number) and memory (by address) the instruction changed
+	Registers map[int]uint8    `json:"registers,omitempty"`
+	Memory    map[uint16]uint8 `json:"memory,omitempty"`
+	Index     uint16           `json:"index"`
+}
+
+// tracer writes a TraceStep for each instruction executed
+type tracer struct {
+	enc    *json.Encoder
+	cycles int
+	// State before the instruction being traced
+	variables [16]uint8
+	memory    [4096]byte
+	step      TraceStep
+}
+
+// begin records the state before the next instruction is executed
+func (t *tracer) begin(vm *VM) {
+	t.variables = vm.variables
+	t.memory = vm.memory
+	t.step = TraceStep{
+		Cycle:      t.cycles,
+		PC:         vm.pc,
+		DelayTimer: vm.delayTimer,
+		SoundTimer: vm.soundTimer,
+	}
+	t.cycles++
+}
+
+// end completes the step for the instruction just executed, recording what it changed
+func (t *tracer) end(vm *VM) TraceStep {
+	step := t.step
+	step.Opcode = vm.opcode
+	step.Index = vm.index
+	for i, v := range vm.variables {
+		if v != t.variables[i] {
+			if step.Registers == nil {
+				step.Registers = map[int]uint8{}
+			}
+			step.Registers[i] = v
+		}
+	}
+	for addr, b := range vm.memory {
+		if b != t.memory[addr] {
+			if step.Memory == nil {
+				step.Memory = map[uint16]uint8{}
+			}
+			step.Memory[uint16(addr)] = b
+		}
+	}
+	return step
+}
+
+// traceCycle executes a cycle, writing it to the trace
+func (vm *VM) traceCycle() {
+	t := vm.tracer
+	t.begin(vm)
+	vm.executeCycle()
+	if err := t.enc.Encode(t.end(vm)); err != nil {
+		vm.logf(LogError, "trace: %v, tracing stopped", err)
+		vm.tracer = nil
+	}
+}
+
+// VerifyTrace replays a trace written by WithTrace, checking that each instruction executes at
+// the same address with the same opcode and changes the same registers and memory. The VM must be
+// set up as the traced one was: the same ROM loaded, and the same random source and input.
+// It returns an error describing the first step that differs
+func (vm *VM) VerifyTrace(r io.Reader) error {
+	_, err := vm.CompareRun(NewTraceReader(r), math.MaxInt32)
+	return err
+}
+
+// Tracer is a reference implementation of CHIP-8 that CompareRun runs the VM in lock-step with,
+// such as another emulator, another VM (see NewVMTracer) or a recorded trace (see
+// NewTraceReader)
+type Tracer interface {
+	// Next executes the reference's next instruction, returning the step it took, or io.EOF if
+	// it has no more
+	Next() (TraceStep, error)
+}
+
+// CompareRun runs the VM in lock-step with reference for up to maxCycles instructions, checking
+// after each that it executed the same instruction at the same address and changed the same
+// registers and memory. Timers are set to the reference's before each instruction, as they count
+// down in real time. It returns the cycle at which the VM diverged from the reference, with an
+// error describing how, or -1 if they agreed until the reference ran out or maxCycles were run.
+// An error executing either implementation's instruction is returned with the cycle it happened
+func (vm *VM) CompareRun(reference Tracer, maxCycles int) (divergeCycle int, err error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	t := &tracer{}
+	for cycle := 0; cycle < maxCycles; cycle++ {
+		want, err := reference.Next()
+		if err == io.EOF {
+			return -1, nil
+		} else if err != nil {
+			return cycle, err
+		}
+		if vm.pc != want.PC {
+			return cycle, fmt.Errorf("cycle %d: PC is %#04x, the reference has %#04x", want.Cycle, vm.pc, want.PC)
+		}
+		vm.delayTimer, vm.soundTimer = want.DelayTimer, want.SoundTimer
+		t.cycles = want.Cycle
+		got, err := t.run(vm)
+		if err != nil {
+			return cycle, fmt.Errorf("cycle %d: %w", want.Cycle, err)
+		}
+		if !stepsEqual(got, want) {
+			return cycle, fmt.Errorf("cycle %d: %04X at %#04x differs from the reference, got %+v, the reference has %+v",
+				want.Cycle, got.Opcode, got.PC, got, want)
+		}
+	}
+	return -1, nil
+}
+
+// run executes a cycle and returns the step it took. ErrHalt isn't an error, as exiting leaves
+// the PC on 00FD for the trace to carry on from
+func (t *tracer) run(vm *VM) (TraceStep, error) {
+	t.begin(vm)
+	vm.executeCycle()
+	err := vm.stopErr
+	vm.stopErr = nil
+	if err != nil && !errors.Is(err, ErrHalt) {
+		return TraceStep{}, err
+	}
+	return t.end(vm), nil
+}
+
+// traceReader is a Tracer replaying a trace written by WithTrace
+type traceReader struct {
+	dec *json.Decoder
+}
+
+// NewTraceReader returns a Tracer that replays the steps of a trace written by WithTrace
+func NewTraceReader(r io.Reader) Tracer {
+	return &traceReader{dec: json.NewDecoder(r)}
+}
+
+func (r *traceReader) Next() (TraceStep, error) {
+	var step TraceStep
+	if err := r.dec.Decode(&step); err == io.EOF {
+		return step, io.EOF
+	} else if err != nil {
+		return step, fmt.Errorf("reading trace: %w", err)
+	}
+	return step, nil
+}
+
+// vmTracer is a Tracer executing the instructions of another VM
+type vmTracer struct {
+	vm *VM
+	t  tracer
+}
+
+// NewVMTracer returns a Tracer that executes instructions of ref, which should be set up with the
+// same ROM, e.g. to compare a VM against one with different options. ref's timers aren't ticked
+func NewVMTracer(ref *VM) Tracer {
+	return &vmTracer{vm: ref}
+}
+
+func (r *vmTracer) Next() (TraceStep, error) {
+	r.vm.mu.Lock()
+	defer r.vm.mu.Unlock()
+	step, err := r.t.run(r.vm)
+	if err != nil {
+		return step, fmt.Errorf("reference: %w", err)
+	}
+	return step, nil
+}
+
+func stepsEqual(a, b TraceStep) bool {
+	if a.Opcode != b.Opcode || a.Index != b.Index || len(a.Registers) != len(b.Registers) ||
+		len(a.Memory) != len(b.Memory) {
+		return false
+	}
+	for i, v := range a.Registers {
+		if w, ok := b.Registers[i]; !ok || v != w {
+			return false
+		}
+	}
+	for addr, v := range a.Memory {
+		if w, ok := b.Memory[addr]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
@@ -1,14 +1,135 @@
 package vm
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Frequency (Hz) at which the delay and sound timers are decremented
+	timerFrequency = 60
+	// Default number of cycles executed per second
+	defaultClockSpeed = 700
+	// Cycles executed per 60Hz frame when running without reference to wall-clock time, ~700Hz
+	defaultCyclesPerFrame = 11
+	// How far the run loop may fall behind the clock speed before it gives up catching up
+	maxCatchUp = 100 * time.Millisecond
+	// How long the run loop sleeps between checks while paused
+	pausedPollInterval = 10 * time.Millisecond
+)
+
+// ErrHalt is returned by Run when the ROM exits the interpreter with the SUPER-CHIP 00FD
+// instruction, so it is a normal end to the run rather than a failure
+var ErrHalt = errors.New("ROM exited")
+
+// ErrPCOutOfBounds is returned by Run when the PC runs past the end of memory, e.g. because a ROM
+// is truncated or missing a jump, unless a different PCPolicy is set
+var ErrPCOutOfBounds = errors.New("PC out of bounds")
+
+// PCPolicy is what to do when the PC runs past the end of memory, see WithPCPolicy
+type PCPolicy int
+
+const (
+	// Stop, returning ErrPCOutOfBounds (the default)
+	PCError PCPolicy = iota
+	// Jump back to the start of the program at 0x200
+	PCWrap
+	// Stop executing instructions but keep running, as if in an infinite loop
+	PCHalt
+)
+
+// Renderer draws the contents of the display buffer, see display.Display
+type Renderer interface {
+	Render(pixels [64][32]byte)
+}
+
+// AudioBeeper plays the tone while the sound timer is running, see audio.Bell and audio.Silent
+type AudioBeeper interface {
+	// Start begins playing a tone of freq Hz, until Stop is called
+	Start(freq float64)
+	Stop()
+}
+
+// beepFrequency is the pitch of the tone played while the sound timer is running, in Hz
+const beepFrequency = 440
+
+// hiresRenderer is implemented by renderers that can draw the 64x64 HIRES display. Other
+// renderers are given the top half of it
+type hiresRenderer interface {
+	RenderHires(pixels [64][64]byte)
+}
+
+// HiresMode is whether to run ROMs in the 64x64 HIRES mode of the COSMAC VIP's two-page display
+// interpreter, see WithHires
+type HiresMode int
 
-	"github.com/JoshCooperr/chip8/pkg/display"
+const (
+	// Always use the standard 64x32 display (the default)
+	HiresOff HiresMode = iota
+	// Use HIRES mode for ROMs that begin with its startup code
+	HiresDetect
+	// Always use HIRES mode
+	HiresOn
 )
 
+const (
+	// HIRES ROMs begin by jumping to 0x260, where a patch to the original interpreter is loaded.
+	// The CHIP-8 program itself starts at 0x2C0
+	hiresStartup = 0x1260
+	hiresEntry   = 0x2C0
+)
+
+// MemoryProtection is what to do when an instruction writes to the memory below 0x200, which is
+// reserved for the interpreter (and the font), see WithProtectReservedMemory
+type MemoryProtection int
+
+const (
+	// Allow the write (the default)
+	ProtectOff MemoryProtection = iota
+	// Allow the write, but log a warning
+	ProtectLog
+	// Fail the instruction with ErrReservedMemory
+	ProtectError
+)
+
+// Input reports the state of the 16 key hex keypad (keys 0x0-0xF), see display.Display and
+// keypad.Keypad
+type Input interface {
+	// IsPressed reports whether key is currently held down
+	IsPressed(key byte) bool
+}
+
+// focuser is implemented by renderers backed by a window that can gain and lose focus
+type focuser interface {
+	Focused() bool
+}
+
+// closer is implemented by renderers backed by a window that the user can close
+type closer interface {
+	Closed() bool
+}
+
+// inputUpdater is implemented by renderers that need to poll for window events while nothing is
+// being rendered, e.g. while paused
+type inputUpdater interface {
+	UpdateInput()
+}
+
 type VM struct {
+	// Guards the VM's state, so it can be inspected and controlled (e.g. by a debugger) from
+	// other goroutines while Run is executing
+	mu sync.Mutex
 	// The current opcode being emulated
 	opcode uint16
 	// Direct access memory (4kb RAM)
@@ -25,206 +146,466 @@ type VM struct {
 	delayTimer uint8
 	// Sound timer, decremented at 60Hz -> 0, plays sound if not at 0
 	soundTimer uint8
-	// Variable registers, 16 general purpose 8-bit registers numbered [0-F]
+	// Variable registers, 16 general purpose 8-bit registers numbered [0-F]. VF doubles as the
+	// flag register, used by instructions (e.g. as a carry flag)
 	variables [16]uint8
-	// Flag register, used by instructions (e.g. as a carry flag)
-	vf uint8
 	// Interface to use to draw the game window
-	display *display.Display
-	// Current state of the display
-	pixels [64][32]byte
+	renderer Renderer
+	// Source of key presses for EX9E, EXA1 and FX0A. If nil, no keys are ever pressed
+	input Input
+	// Records each key press and release, if enabled with WithInputLog
+	keyLog *keyLogger
+	// Progress of the FX0A waiting for a key, if any, and how long a key held from before the
+	// wait must be held to count, see WithKeyRepeat
+	keyWait   keyWait
+	keyRepeat time.Duration
+	// Current state of the display. Each pixel is a bitmask of the planes it is lit in, bit 0 for
+	// plane 1 and bit 1 for plane 2 (only used in XO-CHIP mode). Only the top 32 rows are used
+	// unless in HIRES mode
+	pixels [64][64]byte
+	// Whether the display is 64x64 rather than 64x32, and when to switch to it
+	hires     bool
+	hiresMode HiresMode
+	// Bitmask of the planes that drawing and clearing affect, always plane 1 unless in XO-CHIP mode
+	selectedPlane uint8
+	// Optional callback invoked when the sound timer starts (true) or stops (false)
+	soundHook func(active bool)
+	// Optional audio backend that plays the beep, see WithAudio
+	audio AudioBeeper
+	// Sample rate to generate the beep at for an AudioSampler backend, 0 for none, and the
+	// fraction of a sample and the position in the waveform carried over between timer ticks
+	sampleRate  int
+	sampleDebt  float64
+	samplePhase float64
+	// Minimum number of timer ticks a beep lasts for, and the ticks left of the current beep's
+	// minimum, so that very short sound timer values play as a beep rather than a click
+	minSoundTicks int
+	soundHold     int
+	// Whether the sound timer was set by WithSoundTimer, and its beep is yet to be started
+	soundPreset bool
+	// XO-CHIP audio: a 1-bit, 128 sample pattern played while the sound timer is nonzero, and the
+	// pitch that determines its playback rate
+	audioPattern [16]byte
+	pitch        uint8
+	// Optional callbacks invoked before and after each instruction is executed
+	preExecHook  func(*VM)
+	postExecHook func(*VM)
+	// Optional callback that plays a tone when a sprite collides, see WithBeepOnCollision
+	collisionBeep func()
+	// Handlers set by WithHandler, which take precedence over the built in ones
+	handlers map[string]Handler
+	// Whether to record each colliding DXYN, and the collisions recorded, see WithCollisionLog
+	logCollisions bool
+	collisions    []CollisionEvent
+	// If set, DXYN reports where it would draw to this rather than drawing, see WithDrawDryRun
+	drawDryRun func(DrawEvent)
+	// Optional callback given each frame rendered, see SetFrameHook
+	frameHook func(pixels [64][32]byte)
+	// Optional callback invoked when an add into register vx overflows
+	overflowHook func(x int, a, b uint8, pc uint16)
+	// Optional callback invoked when a subtraction into register vx borrows
+	borrowHook func(x int, a, b uint8, pc uint16)
+	// Memory patches applied before each instruction, see AddCheat
+	cheats map[uint16]byte
+	// Addresses of instructions to pause before executing, and whether the run loop has just
+	// paused at one, so that it's executed rather than hit again when execution continues
+	breakpoints  map[uint16]bool
+	atBreakpoint bool
+	// Registers to break on changes to, and an optional callback told of each change
+	watched   [16]bool
+	watchHook func(reg int, old, new uint8, pc uint16)
+	// Whether execution is currently paused
+	paused bool
+	// Whether the timers alone are frozen, see PauseTimers
+	timersPaused bool
+	// Pause while the display window is unfocused, blurPaused records that we paused for this
+	// reason so a user-initiated pause isn't undone when focus returns
+	pauseOnBlur bool
+	blurPaused  bool
+	// Whether the display buffer has changed since it was last rendered
+	dirty bool
+	// Interpreter behaviours ROMs may depend on, and whether to log the first use of each
+	quirks        Quirks
+	quirkWarnings bool
+	quirksWarned  map[string]bool
+	// Set when execution must stop (e.g. the ROM executed 00FD), until the run loop returns it
+	stopErr error
+	// Refuse to execute opcodes missing from the registry, see WithStrictOpcodes
+	strictOpcodes bool
+	// Pause at unknown opcodes rather than stopping, see WithPauseOnUnimplemented
+	pauseOnUnimplemented bool
+	// Ignore unknown 00NN opcodes, logging the first use of each, see WithIgnoreUnknown00NN
+	ignoreUnknown00NN bool
+	// Ignore unknown FXNN opcodes likewise, see WithIgnoreUnknownFXNN
+	ignoreUnknownFXNN bool
+	unknownLogged     map[uint16]bool
+	// What to do if the PC runs past the end of memory
+	pcPolicy PCPolicy
+	// What to do when the ROM writes below 0x200
+	protectReserved MemoryProtection
+	// What memory and registers hold before the ROM writes to them
+	memoryFill MemoryFill
+	// Whether loading a ROM leaves the rest of the program memory as it was, see
+	// WithKeepMemoryOnLoad
+	keepMemoryOnLoad bool
+	// Convert panics in the run loop into errors returned by Run
+	recoverPanics bool
+	// Writes a trace of the instructions executed by Run and RunCycles, if tracing is enabled
+	tracer *tracer
+	// The state before each of the most recent instructions for StepBack, in a ring buffer of
+	// historyDepth slots. historyHead is the slot the next state is saved to, and historyLen the
+	// number of saved states
+	history      []Snapshot
+	historyDepth int
+	historyHead  int
+	historyLen   int
+	// Opcode forms executed, if coverage tracking is enabled
+	coverage map[string]bool
+	// Histogram of instructions executed per rendered frame if enabled, and the instructions
+	// executed since the last render
+	frameStats  map[int]int
+	sinceRender int
+	// Size in bytes of the ROM loaded by LoadROM, its SHA-1 hash in hex and its file name
+	romSize int
+	romHash string
+	romName string
+	// Source of random bytes for CXNN
+	random func() (byte, error)
+	// Enable the XO-CHIP extensions to the instruction set
+	xoChip bool
+	// Coalesce renders so the window is updated at most once per 60Hz frame
+	drawThrottle bool
+	// Renders and cycles performed since rateStart, used to measure the renders per second and the
+	// emulation speed relative to the target clock speed
+	draws      int
+	drawRate   float64
+	cycles     int
+	speed      float64
+	rateStart  time.Time
+	clockSpeed int
+	// 60Hz frames Run waits before starting the ROM, see WithStartDelayFrames
+	startDelayFrames int
+	// When RunFor stops running, zero for no limit
+	deadline time.Time
+	// Time spent running unpaused, not counting the current stretch since runningSince, and the
+	// number of cycles executed, for Uptime and EmulatedTime
+	uptime       time.Duration
+	runningSince time.Time
+	totalCycles  uint64
+	// If nonzero, run exactly this many cycles per 60Hz frame rather than free-running
+	cyclesPerFrame int
+	// Extra cycles each DXYN takes, and how many of those the run loop has still to sit out
+	drawCycleCost int
+	stall         int
+	// Where diagnostic messages are written, and the most verbose level written, see SetLogger
+	logger   Logger
+	logLevel LogLevel
 }
 
-func (vm *VM) Init(display display.Display) error {
-	vm.display = &display
+func (vm *VM) Init(renderer Renderer, opts ...Option) error {
+	vm.renderer = renderer
 	vm.pc = 0x200
+	vm.selectedPlane = 1
+	vm.pitch = 64
+	vm.clockSpeed = defaultClockSpeed
+	vm.logger = discardLogger{}
+	vm.logLevel = LogInfo
+	vm.random = func() (byte, error) {
+		return byte(rand.Uint32()), nil
+	}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	vm.fill()
 	return nil
 }
 
+// Instruction is an opcode decoded into its various nibbles (half bytes)
+type Instruction struct {
+	Opcode uint16
+	Instr  uint16 // 1st nibble, the type of instruction
+	X      uint16 // 2nd nibble, used to look up a register (vx) in variables
+	Y      uint16 // 3rd nibble, used to look up a register (vy) in variables
+	N      uint16 // 4th nibble, a 4-bit number
+	NN     uint16 // 2nd byte, an 8-bit number
+	NNN    uint16 // 2nd, 3rd & 4th nibbles, a 12-bit memory address
+	// Assembly mnemonic and description from the opcode registry, set by CurrentInstruction only,
+	// as they aren't needed to execute it
+	Mnemonic    string
+	Description string
+}
+
+// fetch returns the opcode at the PC without advancing it
+func (vm *VM) fetch() uint16 {
+	// Combine the two successive bytes indicated by the PC. The first byte must be shifted
+	// left 8 (eg. 10100110 -> 1010011000000000) then OR'd with the following byte
+	return uint16(vm.memory[vm.pc])<<8 | uint16(vm.memory[vm.pc+1])
+}
+
+// decode extracts the various nibbles from an opcode
+func decode(opcode uint16) Instruction {
+	return Instruction{
+		Opcode: opcode,
+		Instr:  opcode & 0xF000,
+		X:      opcode & 0x0F00 >> 8,
+		Y:      opcode & 0x00F0 >> 4,
+		N:      opcode & 0x000F,
+		NN:     opcode & 0x00FF,
+		NNN:    opcode & 0x0FFF,
+	}
+}
+
 func (vm *VM) executeCycle() {
-	// Fetch next opcode by combining the two successive bytes indicated by the PC.
-	// The first byte must be shifted left 8 (eg. 10100110 -> 1010011000000000)
-	// then OR'd with the following byte to retrieve the opcode
-	vm.opcode = uint16(vm.memory[vm.pc])<<8 | uint16(vm.memory[vm.pc+1])
+	vm.atBreakpoint = false
+	if int(vm.pc)+1 >= len(vm.memory) && !vm.handlePCOutOfBounds() {
+		return
+	}
+	if vm.historyDepth > 0 {
+		vm.recordHistory()
+	}
+	if len(vm.cheats) > 0 {
+		vm.applyCheats()
+	}
+	if vm.keyLog != nil && vm.input != nil {
+		vm.keyLog.poll(vm.input)
+	}
+	if vm.preExecHook != nil {
+		vm.preExecHook(vm)
+	}
+	vm.opcode = vm.fetch()
 	vm.pc += 2
-
-	// Extract the various nibbles (half bytes) from the opcode
-	instr := vm.opcode & 0xF000  // 1st nibble, the type of instruction
-	x := vm.opcode & 0x0F00 >> 8 // 2nd nibble, used to look up a register (vx) in variables
-	y := vm.opcode & 0x00F0 >> 4 // 3rd nibble, used to look up a register (vy) in variables
-	n := vm.opcode & 0x000F      // 4th nibble, a 4-bit number
-	nn := vm.opcode & 0x00FF     // 2nd byte, an 8-bit number
-	nnn := vm.opcode & 0x0FFF    // 2nd, 3rd & 4th nibbles, a 12-bit memory address
-
-	switch instr {
-	case 0x0000:
-		switch vm.opcode & 0x00FF {
-		case 0x00E0:
-			// Clear the screen
-			vm.pixels = [64][32]byte{}
-		case 0x00EE:
-			// Return from a subroutine, pop address from stack and assign to PC
-			vm.pc = vm.stack[vm.sp]
-			vm.sp -= 1
+	var err error
+	if vm.strictOpcodes && !vm.supported(vm.opcode) {
+		err = ErrUnknownOpcode
+	} else {
+		err = vm.execute(decode(vm.opcode))
+	}
+	if err != nil {
+		// Stay on the instruction that failed
+		vm.pc -= 2
+		unimplemented := errors.Is(err, ErrUnknownOpcode) || errors.Is(err, ErrNotImplemented)
+		if vm.pauseOnUnimplemented && unimplemented && !vm.paused {
+			vm.logf(LogWarn, "paused at %04X at %#04x: %v", vm.opcode, vm.pc, err)
+			vm.pause()
+			return
 		}
+		vm.stopErr = &ExecError{PC: vm.pc, Opcode: vm.opcode, Err: err}
+		return
+	}
+	vm.totalCycles++
+	if vm.coverage != nil {
+		vm.coverage[opcodeForm(vm.opcode)] = true
+	}
+	if vm.frameStats != nil {
+		vm.sinceRender++
+	}
+	if vm.postExecHook != nil {
+		vm.postExecHook(vm)
+	}
+}
 
-	case 0x1000:
-		// Jump by setting PC to nnn
-		vm.pc = nnn
-
-	case 0x2000:
-		// Call the subroutine at nnn in memory, set PC to this after saving current value to
-		// the stack so the subroutine can return later
-		vm.sp += 1
-		vm.stack[vm.sp] = vm.pc
-		vm.pc = nnn
-
-	case 0x3000:
-		// Skip the next instruction if the value in register vx == nn
-		if vm.variables[x] == uint8(nn) {
-			vm.pc += 2
-		}
+// handlePCOutOfBounds applies the PC policy when the PC has run past the end of memory, and
+// reports whether to go on and execute a cycle
+func (vm *VM) handlePCOutOfBounds() bool {
+	switch vm.pcPolicy {
+	case PCWrap:
+		vm.pc = 0x200
+		return true
+	case PCHalt:
+		return false
+	default:
+		vm.stopErr = fmt.Errorf("%w: %#04x", ErrPCOutOfBounds, vm.pc)
+		return false
+	}
+}
 
-	case 0x4000:
-		// Skip the next instruction if the value in register vx != nn
-		if vm.variables[x] != uint8(nn) {
-			vm.pc += 2
+// runCycle executes a cycle for the run loop, returning ErrHalt if the ROM exited,
+// ErrPCOutOfBounds if it ran off the end of memory or an ExecError if the instruction couldn't be
+// executed. With panic recovery enabled, a panic while executing the instruction (e.g. a bug in a
+// hook) is returned as an error identifying the instruction rather than crashing the process. At a
+// breakpoint it pauses instead of executing anything
+func (vm *VM) runCycle() (err error) {
+	defer func() {
+		if err == nil && vm.stopErr != nil {
+			err, vm.stopErr = vm.stopErr, nil
 		}
-
-	case 0x5000:
-		// Skip the next instruction if the values in registers vx == vy
-		if vm.variables[x] == vm.variables[y] {
-			vm.pc += 2
+	}()
+	if vm.breakpoints[vm.pc] && !vm.atBreakpoint {
+		vm.atBreakpoint = true
+		vm.pause()
+		return nil
+	}
+	if !vm.recoverPanics {
+		vm.runOrTraceCycle()
+		return nil
+	}
+	pc := vm.pc
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic executing %04X at %#04x: %v", vm.opcode, pc, r)
 		}
+	}()
+	vm.runOrTraceCycle()
+	return nil
+}
 
-	case 0x6000:
-		// Set register vx to the value in nn
-		vm.variables[x] = uint8(nn)
-
-	case 0x7000:
-		// Add to register vx the value in nn
-		vm.variables[x] += uint8(nn)
-
-	case 0x8000:
-		// Bitwise operations
-		switch vm.opcode & 0x000F {
-		case 0x0000:
-			// Set register vx = vy
-			vm.variables[x] = vm.variables[y]
-		case 0x0001:
-			// Set register vx = vx OR vy
-			vm.variables[x] = vm.variables[x] | vm.variables[y]
-		case 0x0002:
-			// Set register vx = vx AND vy
-			vm.variables[x] = vm.variables[x] & vm.variables[y]
-		case 0x0003:
-			// Set register vx = vx XOR vy
-			vm.variables[x] = vm.variables[x] ^ vm.variables[y]
-		case 0x0004:
-			// Set register vx = vx + vy
-			vm.variables[x] = vm.variables[x] + vm.variables[y]
-		case 0x0005:
-			// Set register vx = vx - vy
-			vm.variables[x] = vm.variables[x] - vm.variables[y]
-		case 0x0006:
-			// Set register vx = vy > 1 (if bit shifted out was 1 then set vf = 1)
-			if vm.variables[y]&0x01 == 0x1 {
-				vm.vf = 1
-			}
-			vm.variables[x] = vm.variables[y] >> 1
-		case 0x0007:
-			// Set register vx = vy - vx
-			vm.variables[x] = vm.variables[y] - vm.variables[x]
-		case 0x000E:
-			// Set register vx = vy < 1 (if bit shifted out was 1 then set vf = 1)
-			if vm.variables[y]&0x80 == 0x80 {
-				vm.vf = 1
-			}
-			vm.variables[x] = vm.variables[y] << 1
-		}
+// runOrTraceCycle executes a cycle, writing it to the trace if tracing is enabled. Cycles owed
+// for the last draw (see WithDrawCycleCost) are sat out instead
+func (vm *VM) runOrTraceCycle() {
+	if vm.stall > 0 {
+		vm.stall--
+		vm.totalCycles++
+	} else if vm.tracer != nil {
+		vm.traceCycle()
+	} else {
+		vm.executeCycle()
+	}
+}
 
-	case 0x9000:
-		// Skip the next instruction if the values in registers vx != vy
-		if vm.variables[x] != vm.variables[y] {
-			vm.pc += 2
-		}
+// keyPressed reports whether the key in the low nibble of key is held down
+func (vm *VM) keyPressed(key uint8) bool {
+	return vm.input != nil && vm.input.IsPressed(key&0xF)
+}
+
+// shiftSource returns the value 8XY6/8XYE shift: vy, or vx with the ShiftInPlace quirk
+func (vm *VM) shiftSource(x, y uint16) uint8 {
+	vm.warnQuirk("ShiftInPlace", vm.quirks.ShiftInPlace)
+	if vm.quirks.ShiftInPlace {
+		return vm.variables[x]
+	}
+	return vm.variables[y]
+}
 
-	case 0xA000:
-		// Set the index register to the value in nnn
-		vm.index = nnn
-
-	case 0xB000:
-		// TODO: Make configurable see (https://tobiasvl.github.io/blog/write-a-chip-8-emulator/#bnnn-jump-with-offset)
-		panic(fmt.Errorf("not implemented: %v", vm.opcode))
-
-	case 0xC000:
-		// Generate a random number, r, and set register vx = r AND nn
-		r := uint16(rand.Uint32())
-		vm.variables[x] = uint8(r & nn)
-
-	case 0xD000:
-		// Get the x, y coords from the vx, vy registers as the starting coordinates to draw the
-		// sprite from (these coordinates wrap, hence bitwise AND)
-		xcoord := vm.variables[x] & 63
-		ycoord := vm.variables[y] & 31
-		vm.vf = 0
-		for y := uint16(0); y < n; y++ {
-			spriteRow := vm.memory[vm.index+y]
-			for x := 0; x < 8; x++ {
-				// Iterate over the bits of the sprite byte
-				if (spriteRow & (0x80 >> x)) != 0 {
-					if vm.pixels[xcoord+uint8(x)][ycoord+uint8(y)] == 0xFF {
-						// Set register vf if a pixel is turned ON -> OFF
-						vm.vf = 1
+// logicQuirk resets vf after 8XY1/8XY2/8XY3 with the LogicResetsVF quirk
+func (vm *VM) logicQuirk() {
+	vm.warnQuirk("LogicResetsVF", vm.quirks.LogicResetsVF)
+	if vm.quirks.LogicResetsVF {
+		vm.setRegister(0xF, 0)
+	}
+}
+
+// loadStoreQuirk moves the index register past v0..vx after FX55/FX65 with the
+// LoadStoreIncrementsIndex quirk
+func (vm *VM) loadStoreQuirk(x uint16) {
+	vm.warnQuirk("LoadStoreIncrementsIndex", vm.quirks.LoadStoreIncrementsIndex)
+	if vm.quirks.LoadStoreIncrementsIndex {
+		vm.index += x + 1
+	}
+}
+
+// checkMemory returns an error if the n bytes of memory from addr extend past the end of memory
+func (vm *VM) checkMemory(addr uint16, n int) error {
+	if int(addr)+n > len(vm.memory) {
+		return fmt.Errorf("%w: %d bytes at %#04x", ErrMemoryOutOfBounds, n, addr)
+	}
+	return nil
+}
+
+// checkWrite is checkMemory for instructions that write the n bytes from addr. It also applies
+// the protection of the interpreter's reserved memory below 0x200, see WithProtectReservedMemory
+func (vm *VM) checkWrite(addr uint16, n int) error {
+	if err := vm.checkMemory(addr, n); err != nil {
+		return err
+	}
+	if addr >= 0x200 || vm.protectReserved == ProtectOff {
+		return nil
+	}
+	if vm.protectReserved == ProtectError {
+		return fmt.Errorf("%w: %d bytes at %#04x", ErrReservedMemory, n, addr)
+	}
+	vm.logf(LogWarn, "%04X at %#04x writes %d bytes to reserved memory at %#04x", vm.opcode, vm.pc-2, n, addr)
+	return nil
+}
+
+// planeCount returns the number of XO-CHIP planes selected, each of which DXYN reads a sprite for
+func (vm *VM) planeCount() int {
+	return int(vm.selectedPlane&1 + vm.selectedPlane>>1&1)
+}
+
+// drawSprite XORs the sprite pointed to by the index register, rows tall and width (8 or 16)
+// pixels wide, onto the display with its top left corner at (xcoord, ycoord), and returns the
+// number of pixels turned ON -> OFF, any of which is a collision. With both XO-CHIP planes
+// selected the sprite for plane 2 immediately follows the one for plane 1
+func (vm *VM) drawSprite(xcoord, ycoord uint8, rows, width int) (erased int) {
+	addr := int(vm.index)
+	rowBytes := width / 8
+	for plane := uint8(1); plane <= 2; plane <<= 1 {
+		if vm.selectedPlane&plane == 0 {
+			continue
+		}
+		for y := 0; y < rows; y++ {
+			for x := 0; x < width; x++ {
+				// Iterate over the bits of the sprite's bytes. Sprites are clipped at the edges of
+				// the screen, unless the SpriteWrap quirk wraps them round
+				if !spriteBit(vm.memory[addr+y*rowBytes+x/8], x%8) {
+					continue
+				}
+				px, py := int(xcoord)+x, int(ycoord)+y
+				if px >= len(vm.pixels) || py >= vm.screenHeight() {
+					vm.warnQuirk("SpriteWrap", vm.quirks.SpriteWrap)
+					if !vm.quirks.SpriteWrap {
+						continue
 					}
-					vm.pixels[xcoord+uint8(x)][ycoord+uint8(y)] ^= 0xFF // XOR display pixel with sprite
+					px, py = px%len(vm.pixels), py%vm.screenHeight()
 				}
+				if vm.pixels[px][py]&plane != 0 {
+					erased++
+				}
+				vm.pixels[px][py] ^= plane // XOR display pixel with sprite
 			}
 		}
-		vm.display.Render(vm.pixels)
-
-	case 0xF000:
-		// Timer manipulation
-		switch vm.opcode & 0x00FF {
-		case 0x0007:
-			// Set vx to the value of the delay timer
-			vm.variables[x] = vm.delayTimer
-		case 0x0015:
-			// Set delay timer to value in vx
-			vm.delayTimer = vm.variables[x]
-		case 0x0018:
-			// Set sound timer to value in vx
-			vm.soundTimer = vm.variables[x]
-		case 0x001E:
-			// Add the value in vx to the index register
-			vm.index += uint16(vm.variables[x])
-		case 0x000A:
-			// Block and wait for key press. If key is pressed then set vx to its hex value
-			panic(fmt.Errorf("not implemented: %x", vm.opcode))
-		case 0x0029:
-			// Font character
-			panic(fmt.Errorf("not implemented: %x", vm.opcode))
-		case 0x0033:
-			// Binary-coded decimal conversion, get the value in vx and convert to 3 decimal digits
-			// (eg. 156 -> 1, 5, 6) and store in memory (addresses determined by index register)
-			dec := vm.variables[x]
-			vm.memory[vm.index] = dec / 100
-			vm.memory[vm.index+1] = dec / 10 % 10
-			vm.memory[vm.index+2] = dec % 10
-		case 0x0055:
-			// Save the values in the variable registers into memory (addresses determined by index register)
-			for i := 0; i < len(vm.variables); i++ {
-				vm.memory[vm.index+uint16(i)] = vm.variables[i]
-			}
-		case 0x0065:
-			// Load values from memory (addresses determined by index register) into the variable registers
-			for i := 0; i < len(vm.variables); i++ {
-				vm.variables[i] = vm.memory[vm.index+uint16(i)]
-			}
-		default:
-			panic(fmt.Errorf("unknown opcode: %x", vm.opcode))
+		addr += rows * rowBytes
+	}
+	return erased
+}
+
+// warnUnknown logs the first time the current opcode, an unknown 00NN or FXNN opcode, is ignored
+func (vm *VM) warnUnknown() {
+	if vm.unknownLogged[vm.opcode] {
+		return
+	}
+	if vm.unknownLogged == nil {
+		vm.unknownLogged = map[uint16]bool{}
+	}
+	vm.unknownLogged[vm.opcode] = true
+	vm.logf(LogWarn, "ignoring unknown opcode %04X at %#x", vm.opcode, vm.pc-2)
+}
+
+// clearScreen turns off every pixel in the selected planes
+func (vm *VM) clearScreen() {
+	for x := range vm.pixels {
+		for y := range vm.pixels[x] {
+			vm.pixels[x][y] &^= vm.selectedPlane
+		}
+	}
+	vm.dirty = true
+}
+
+// screenHeight returns the number of rows of the display, 64 in HIRES mode and 32 otherwise
+func (vm *VM) screenHeight() int {
+	if vm.hires {
+		return 64
+	}
+	return 32
+}
+
+// spriteBit reports whether bit x of a sprite row is set, counting from the leftmost (MSB) bit
+func spriteBit(row byte, x int) bool {
+	return row&(0x80>>x) != 0
+}
+
+// registerRange returns the register numbers from x to y inclusive, counting down if x > y
+func registerRange(x, y uint16) []uint16 {
+	var regs []uint16
+	for r := x; r != y; {
+		regs = append(regs, r)
+		if x < y {
+			r++
+		} else {
+			r--
 		}
 	}
+	return append(regs, y)
 }
 
 func (vm *VM) LoadROM(filename string) error {
@@ -235,22 +616,816 @@ func (vm *VM) LoadROM(filename string) error {
 		return err
 	}
 
-	// Sanity check the size of the ROM
-	if len(bytes) > 4096 {
-		return fmt.Errorf("the size of the ROM (%v) exceeds the 4096 byte limit", len(bytes))
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if err := vm.loadROMBytes(bytes); err != nil {
+		return err
 	}
+	vm.romName = filepath.Base(filename)
+
+	vm.logf(LogInfo, "ROM loaded successfully, size: %v bytes", len(bytes))
+	return nil
+}
+
+// Time allowed for LoadROMURL to download a ROM
+const downloadTimeout = 30 * time.Second
+
+// LoadROMURL downloads a ROM over HTTP(S) and loads it. It fails if the server doesn't respond
+// with 200 OK or the ROM is too large to fit in memory
+func (vm *VM) LoadROMURL(url string) error {
+	client := &http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	// Read one byte more than fits, to tell if the ROM is too large without reading all of it
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxROMSize+1))
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", url, err)
+	}
+	if len(data) > MaxROMSize {
+		return fmt.Errorf("the ROM at %s is larger than the %d bytes available", url, MaxROMSize)
+	}
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if err := vm.loadROMBytes(data); err != nil {
+		return err
+	}
+	// Named after the URL redirected to, if any
+	vm.romName = path.Base(resp.Request.URL.Path)
+
+	vm.logf(LogInfo, "ROM loaded successfully, size: %v bytes", len(data))
+	return nil
+}
+
+// MaxROMSize is the size in bytes of the largest ROM that fits in memory after the 512 bytes
+// reserved for the interpreter
+const MaxROMSize = 4096 - 0x200
+
+// LoadROMBytes loads a ROM already read into memory, e.g. from somewhere other than a file. The
+// memory from 0x200 on is first cleared to its power on contents (see WithMemoryFill), so no
+// bytes of a larger ROM loaded before are left behind, unless WithKeepMemoryOnLoad is set. Nothing
+// else is reset: call Reset first to start the ROM from scratch
+func (vm *VM) LoadROMBytes(data []byte) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.loadROMBytes(data)
+}
 
+func (vm *VM) loadROMBytes(data []byte) error {
+	if !vm.keepMemoryOnLoad && len(data) <= MaxROMSize {
+		vm.fillProgram()
+	}
 	// First 512 bytes of memory are reserved for the CHIP-8 interpreter
-	for i, b := range bytes {
-		vm.memory[i+512] = b
+	if err := vm.loadROMAt(data, 0x200); err != nil {
+		return err
+	}
+	vm.romSize = len(data)
+	hash := sha1.Sum(data)
+	vm.romHash = hex.EncodeToString(hash[:])
+	vm.romName = ""
+	vm.startHires()
+	return nil
+}
+
+// ROMHash returns the SHA-1 hash, in hex, of the ROM last loaded by LoadROM, LoadROMURL or
+// LoadROMBytes, or "" if none has been. It identifies the ROM regardless of its file name, e.g.
+// to check a save state belongs to it
+func (vm *VM) ROMHash() string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.romHash
+}
+
+// ROMName returns the file name of the ROM last loaded by LoadROM or LoadROMURL, or "" if it was
+// loaded some other way
+func (vm *VM) ROMName() string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.romName
+}
+
+// ROMSize returns the size in bytes of the ROM last loaded by LoadROM, LoadROMURL or LoadROMBytes
+func (vm *VM) ROMSize() int {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.romSize
+}
+
+// startHires switches to HIRES mode if the HiresMode calls for it, skipping the HIRES startup
+// code at the start of the ROM if there is any
+func (vm *VM) startHires() {
+	startup := uint16(vm.memory[0x200])<<8|uint16(vm.memory[0x201]) == hiresStartup
+	vm.hires = vm.hiresMode == HiresOn || vm.hiresMode == HiresDetect && startup
+	if vm.hires && startup {
+		vm.pc = hiresEntry
+	}
+}
+
+// Hires reports whether the display is in the 64x64 HIRES mode
+func (vm *VM) Hires() bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.hires
+}
+
+// LoadROMAt copies data into memory starting at addr, e.g. to compose memory from several
+// sources before running. It fails if data would extend past the end of memory
+func (vm *VM) LoadROMAt(data []byte, addr uint16) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.loadROMAt(data, addr)
+}
+
+func (vm *VM) loadROMAt(data []byte, addr uint16) error {
+	if int(addr)+len(data) > len(vm.memory) {
+		return fmt.Errorf("the size of the ROM (%v) exceeds the %v bytes available at %#x",
+			len(data), len(vm.memory)-int(addr), addr)
 	}
+	copy(vm.memory[addr:], data)
+	return nil
+}
+
+// SetSoundHook registers a callback that is invoked whenever the sound timer transitions from
+// 0 to nonzero (active = true) and back to 0 (active = false). Pass nil to remove the hook. The
+// current state can be polled with IsBeeping
+func (vm *VM) SetSoundHook(fn func(active bool)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.soundHook = fn
+}
+
+// IsBeeping reports whether a beep is currently playing: the sound timer is nonzero (or the
+// minimum beep duration hasn't passed) and the VM isn't paused. It agrees with the last
+// transition reported to the sound hook
+func (vm *VM) IsBeeping() bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.sounding() && !vm.paused
+}
+
+// AddBreakpoint makes Run pause before executing the instruction at addr. Once resumed, or
+// stepped, the instruction executes as normal
+func (vm *VM) AddBreakpoint(addr uint16) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.breakpoints == nil {
+		vm.breakpoints = map[uint16]bool{}
+	}
+	vm.breakpoints[addr] = true
+}
 
-	fmt.Printf("ROM loaded successfully, size: %v bytes\n", len(bytes))
+// RemoveBreakpoint removes the breakpoint at addr set by AddBreakpoint
+func (vm *VM) RemoveBreakpoint(addr uint16) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	delete(vm.breakpoints, addr)
+}
+
+// WatchRegister sets a watchpoint on register vi: an instruction that changes its value pauses
+// the VM, like a breakpoint, after the instruction completes. The change is also reported to the
+// hook set by SetRegisterWatchHook. i is in the range [0-F]
+func (vm *VM) WatchRegister(i int) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if i < 0 || i >= len(vm.watched) {
+		return fmt.Errorf("register index %d out of range [0-15]", i)
+	}
+	vm.watched[i] = true
 	return nil
 }
 
-func (vm *VM) Run() {
-	for {
+// UnwatchRegister removes the watchpoint on register vi set by WatchRegister
+func (vm *VM) UnwatchRegister(i int) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if i < 0 || i >= len(vm.watched) {
+		return fmt.Errorf("register index %d out of range [0-15]", i)
+	}
+	vm.watched[i] = false
+	return nil
+}
+
+// SetRegisterWatchHook registers a callback that is invoked whenever an instruction changes the
+// value of a watched register from old to new, with the address of that instruction. It's
+// called while the VM is locked, like the exec hooks. Pass nil to remove the hook
+func (vm *VM) SetRegisterWatchHook(fn func(reg int, old, new uint8, pc uint16)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.watchHook = fn
+}
+
+// setRegister sets register vr to value on behalf of the instruction being executed, checking
+// for watchpoints
+func (vm *VM) setRegister(r uint16, value uint8) {
+	old := vm.variables[r]
+	vm.variables[r] = value
+	if !vm.watched[r] || old == value {
+		return
+	}
+	if vm.watchHook != nil {
+		// The PC has already moved past the instruction
+		vm.watchHook(int(r), old, value, vm.pc-2)
+	}
+	vm.pause()
+}
+
+// SetFrameHook registers a callback that is given a copy of the screen each time a frame is
+// rendered, in addition to (or without) the renderer, e.g. to embed the emulator in an application
+// that does its own drawing. It's called with the VM locked, so it mustn't call back into the VM.
+// In HIRES mode it's given the top 32 rows only. Pass nil to remove the hook
+func (vm *VM) SetFrameHook(fn func(pixels [64][32]byte)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.frameHook = fn
+}
+
+// SetOverflowHook registers a callback that is invoked whenever 7XNN or 8XY4 adds a and b into
+// register vx and the 8-bit result wraps around, which is often an unintended bug in a ROM, with
+// the address of the instruction. It's called while the VM is locked, like the exec hooks. Pass
+// nil to remove the hook.
+func (vm *VM) SetOverflowHook(fn func(x int, a, b uint8, pc uint16)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.overflowHook = fn
+}
+
+func (vm *VM) checkOverflow(x uint16, a, b uint8) {
+	if vm.overflowHook != nil && uint16(a)+uint16(b) > 0xFF {
+		vm.overflowHook(int(x), a, b, vm.pc-2)
+	}
+}
+
+// SetBorrowHook registers a callback that is invoked whenever 8XY5 or 8XY7 subtracts b from a
+// into register vx and the result wraps around below zero, e.g. a countdown going past zero, with
+// the address of the instruction. It's called while the VM is locked, like the exec hooks. Pass
+// nil to remove the hook.
+func (vm *VM) SetBorrowHook(fn func(x int, a, b uint8, pc uint16)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.borrowHook = fn
+}
+
+func (vm *VM) checkBorrow(x uint16, a, b uint8) {
+	if vm.borrowHook != nil && b > a {
+		vm.borrowHook(int(x), a, b, vm.pc-2)
+	}
+}
+
+// AudioPattern returns the XO-CHIP audio pattern (128 1-bit samples, most significant bit first)
+// and the rate in samples per second it should be played back at while the sound timer is
+// nonzero. Audio backends in XO-CHIP mode should loop this pattern rather than a fixed tone
+func (vm *VM) AudioPattern() (pattern [16]byte, rate float64) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.audioPattern, vm.patternRate()
+}
+
+// patternRate returns the rate in samples per second the audio pattern is played back at, set by
+// FX3A
+func (vm *VM) patternRate() float64 {
+	return 4000 * math.Pow(2, (float64(vm.pitch)-64)/48)
+}
+
+// SetPreExecHook registers a callback invoked before each instruction is executed, e.g. to force
+// a register value every cycle. Hooks run while the VM is locked, so they mustn't call the VM's
+// exported methods, which lock it. Pass nil to remove the hook.
+func (vm *VM) SetPreExecHook(fn func(*VM)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.preExecHook = fn
+}
+
+// SetPostExecHook registers a callback invoked after each instruction is executed, with the same
+// restrictions as SetPreExecHook. Pass nil to remove the hook.
+func (vm *VM) SetPostExecHook(fn func(*VM)) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.postExecHook = fn
+}
+
+// startPresetSound starts the beep of a sound timer set by WithSoundTimer, once the VM starts
+// running and any audio backend and hooks are in place
+func (vm *VM) startPresetSound() {
+	if !vm.soundPreset {
+		return
+	}
+	vm.soundPreset = false
+	value := vm.soundTimer
+	vm.soundTimer = 0
+	vm.setSoundTimer(value)
+}
+
+func (vm *VM) setSoundTimer(value uint8) {
+	wasActive := vm.sounding()
+	vm.soundTimer = value
+	if value != 0 && !wasActive {
+		vm.soundHold = vm.minSoundTicks
+	}
+	vm.notifySound(wasActive)
+}
+
+// sounding reports whether a beep should be playing: while the sound timer is nonzero, and for at
+// least the minimum beep duration after it started
+func (vm *VM) sounding() bool {
+	return vm.soundTimer != 0 || vm.soundHold != 0
+}
+
+// notifySound calls the sound hook and audio backend if the sound has started or stopped. Notify
+// them only on transitions, not on every write
+func (vm *VM) notifySound(wasActive bool) {
+	if active := vm.sounding(); wasActive != active {
+		vm.beep(active)
+	}
+}
+
+// beep tells the sound hook and the audio backend that the beep has started or stopped
+func (vm *VM) beep(active bool) {
+	if vm.soundHook != nil {
+		vm.soundHook(active)
+	}
+	if vm.audio == nil {
+		return
+	}
+	if active {
+		vm.audio.Start(beepFrequency)
+	} else {
+		vm.audio.Stop()
+	}
+}
+
+func (vm *VM) tickTimers() {
+	if vm.timersPaused {
+		return
+	}
+	vm.startPresetSound()
+	if vm.delayTimer > 0 {
+		vm.delayTimer -= 1
+	}
+	wasActive := vm.sounding()
+	if wasActive {
+		vm.playSamples()
+	}
+	if vm.soundTimer > 0 {
+		vm.soundTimer -= 1
+	}
+	if vm.soundHold > 0 {
+		vm.soundHold -= 1
+	}
+	vm.notifySound(wasActive)
+}
+
+// Pause stops the VM executing cycles and counting down its timers until Resume is called
+func (vm *VM) Pause() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.pause()
+}
+
+func (vm *VM) pause() {
+	if vm.paused {
+		return
+	}
+	vm.paused = true
+	// Silence any ongoing beep while paused
+	if vm.sounding() {
+		vm.beep(false)
+	}
+}
+
+// Resume continues execution after a call to Pause
+func (vm *VM) Resume() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.resume()
+}
+
+func (vm *VM) resume() {
+	if !vm.paused {
+		return
+	}
+	vm.paused = false
+	vm.blurPaused = false
+	if vm.sounding() {
+		vm.beep(true)
+	}
+}
+
+// Paused reports whether the VM is currently paused
+func (vm *VM) Paused() bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.paused
+}
+
+// PauseTimers freezes the delay and sound timers until ResumeTimers is called, while the VM
+// carries on executing cycles, e.g. to step through timer dependent code without the timers
+// counting down in between. It's independent of Pause: pausing the VM also stops the timers, but
+// resuming it leaves them frozen if they were paused here. A beep in progress holds while the sound
+// timer is frozen
+func (vm *VM) PauseTimers() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.timersPaused = true
+}
+
+// ResumeTimers continues counting down the timers after a call to PauseTimers
+func (vm *VM) ResumeTimers() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.timersPaused = false
+}
+
+// TimersPaused reports whether the timers are frozen by PauseTimers
+func (vm *VM) TimersPaused() bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.timersPaused
+}
+
+// Step executes a single instruction, intended for use while paused (e.g. from a debugger). It
+// returns an error if the instruction couldn't be executed, or stopped the ROM
+func (vm *VM) Step() error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.step()
+}
+
+func (vm *VM) step() error {
+	vm.executeCycle()
+	err := vm.stopErr
+	vm.stopErr = nil
+	return err
+}
+
+// StepN executes up to n instructions like Step, returning how many were executed. It stops
+// early, before executing it, at any instruction with a breakpoint other than the first, and at
+// an instruction that couldn't be executed or stopped the ROM, returning the error
+func (vm *VM) StepN(n int) (int, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	for i := 0; i < n; i++ {
+		if i > 0 && vm.breakpoints[vm.pc] {
+			return i, nil
+		}
 		vm.executeCycle()
+		if err := vm.stopErr; err != nil {
+			vm.stopErr = nil
+			return i, err
+		}
 	}
+	return n, nil
+}
+
+// Skip moves the PC past the next instruction without executing it, e.g. to carry on past an
+// unimplemented opcode the VM paused at (see WithPauseOnUnimplemented)
+func (vm *VM) Skip() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.pc += 2
+}
+
+// ExecuteOpcode executes opcode against the current state, as if it were the instruction at the
+// PC, without it needing to be in memory, e.g. to experiment from a REPL or in tests: set up the
+// registers, call ExecuteOpcode(0x8124) and check the result. The PC advances past it, or jumps,
+// as usual. Only the opcode itself bypasses memory: instructions that access memory through the
+// index register, such as DXYN and FX65, still read and write the real memory. No hooks, cheats
+// or breakpoints apply. It returns an error if the opcode couldn't be executed, or stopped the ROM
+func (vm *VM) ExecuteOpcode(opcode uint16) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.opcode = opcode
+	vm.pc += 2
+	if err := vm.execute(decode(opcode)); err != nil {
+		vm.pc -= 2
+		return &ExecError{PC: vm.pc, Opcode: opcode, Err: err}
+	}
+	err := vm.stopErr
+	vm.stopErr = nil
+	return err
+}
+
+func (vm *VM) checkFocus() {
+	f, ok := vm.renderer.(focuser)
+	if !ok {
+		return
+	}
+	focused := f.Focused()
+	if !focused && !vm.paused {
+		vm.pause()
+		vm.blurPaused = true
+	} else if focused && vm.blurPaused {
+		vm.resume()
+	}
+}
+
+// present renders the display buffer
+func (vm *VM) present() {
+	vm.render()
+	if vm.frameHook != nil {
+		var pixels [64][32]byte
+		for x := range pixels {
+			copy(pixels[x][:], vm.pixels[x][:])
+		}
+		vm.frameHook(pixels)
+	}
+	vm.dirty = false
+	vm.draws++
+	if vm.frameStats != nil {
+		vm.recordFrameStats()
+	}
+}
+
+// endFrame renders any drawing pending at the end of a frame of the run loop. Otherwise it polls
+// for window events, so that keys are still seen while the ROM draws nothing, e.g. in FX0A
+func (vm *VM) endFrame() {
+	if vm.dirty {
+		vm.present()
+	} else if u, ok := vm.renderer.(inputUpdater); ok {
+		u.UpdateInput()
+	}
+}
+
+// render draws the screen with the renderer, if there is one
+func (vm *VM) render() {
+	if h, ok := vm.renderer.(hiresRenderer); ok && vm.hires {
+		h.RenderHires(vm.pixels)
+	} else if vm.renderer != nil {
+		var pixels [64][32]byte
+		for x := range pixels {
+			copy(pixels[x][:], vm.pixels[x][:])
+		}
+		vm.renderer.Render(pixels)
+	}
+}
+
+// DrawsPerSecond returns the number of times per second the display was actually rendered,
+// measured over the last second of running
+func (vm *VM) DrawsPerSecond() float64 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.drawRate
+}
+
+// EmulationSpeed returns the number of cycles actually executed per second as a fraction of the
+// target clock speed, measured over the last second of running. 1.0 means the emulator is
+// keeping up, less than that means the host is too slow
+func (vm *VM) EmulationSpeed() float64 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.speed
+}
+
+// Uptime returns how long the VM has spent running, not counting time paused, e.g. for a play
+// timer
+func (vm *VM) Uptime() time.Duration {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	uptime := vm.uptime
+	if !vm.runningSince.IsZero() {
+		uptime += time.Since(vm.runningSince)
+	}
+	return uptime
+}
+
+// EmulatedTime estimates how much time has passed in the emulated machine from the number of
+// cycles executed and the target clock speed. It falls behind Uptime if the host can't keep up,
+// and counts cycles executed by Step and RunCycles too, which don't run in real time
+func (vm *VM) EmulatedTime() time.Duration {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return time.Duration(float64(vm.totalCycles) / float64(vm.targetSpeed()) * float64(time.Second))
+}
+
+// trackUptime adds the time since the last call to the uptime if the VM was running, and records
+// whether it's running now
+func (vm *VM) trackUptime(running bool) {
+	now := time.Now()
+	if !vm.runningSince.IsZero() {
+		vm.uptime += now.Sub(vm.runningSince)
+	}
+	vm.runningSince = time.Time{}
+	if running {
+		vm.runningSince = now
+	}
+}
+
+// targetSpeed returns the number of cycles per second the run loop aims to execute
+func (vm *VM) targetSpeed() int {
+	if vm.cyclesPerFrame > 0 {
+		return vm.cyclesPerFrame * timerFrequency
+	}
+	return vm.clockSpeed
+}
+
+// updateRates recalculates drawRate and speed once a second has passed since they were last
+// updated
+func (vm *VM) updateRates() {
+	if elapsed := time.Since(vm.rateStart); elapsed >= time.Second {
+		vm.drawRate = float64(vm.draws) / elapsed.Seconds()
+		vm.speed = float64(vm.cycles) / elapsed.Seconds() / float64(vm.targetSpeed())
+		vm.draws = 0
+		vm.cycles = 0
+		vm.rateStart = time.Now()
+	}
+}
+
+// closed reports whether the user has closed the renderer's window
+func (vm *VM) closed() bool {
+	if !vm.deadline.IsZero() && !time.Now().Before(vm.deadline) {
+		return true
+	}
+	c, ok := vm.renderer.(closer)
+	return ok && c.Closed()
+}
+
+// stop silences any ongoing beep, and stops counting the uptime, when the run loop exits
+func (vm *VM) stop() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.trackUptime(false)
+	if vm.sounding() && !vm.paused {
+		vm.beep(false)
+	}
+}
+
+// RunCycles executes n cycles as quickly as possible, without reference to wall-clock time. The
+// timers are counted down (and any pending drawing rendered) once per frame's worth of cycles, so
+// the result is deterministic. It's intended for headless use such as testing. It stops early,
+// returning the error, if the ROM exits (ErrHalt) or the PC runs out of bounds, or returning nil
+// if an instruction pauses the VM, e.g. a watchpoint
+func (vm *VM) RunCycles(n int) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	var err error
+	perFrame := vm.cyclesPerFrame
+	if perFrame == 0 {
+		perFrame = defaultCyclesPerFrame
+	}
+	vm.startPresetSound()
+	paused := vm.paused
+	for i := 1; i <= n; i++ {
+		vm.runOrTraceCycle()
+		if vm.stopErr != nil {
+			err, vm.stopErr = vm.stopErr, nil
+			break
+		}
+		if vm.paused && !paused {
+			break
+		}
+		if i%perFrame == 0 {
+			vm.tickTimers()
+			if vm.dirty {
+				vm.present()
+			}
+		}
+	}
+	if vm.dirty {
+		vm.present()
+	}
+	return err
+}
+
+// Run executes the loaded ROM at the configured clock speed until the display window is closed,
+// at which point it returns nil, or the ROM stops, e.g. returning ErrHalt if it exits
+func (vm *VM) Run() error {
+	defer vm.stop()
+	if vm.startDelay() {
+		return nil
+	}
+	vm.mu.Lock()
+	vm.startPresetSound()
+	vm.mu.Unlock()
+
+	vm.rateStart = time.Now()
+	if vm.cyclesPerFrame > 0 {
+		return vm.runFrames()
+	}
+
+	lastTick := time.Now()
+	// Wall-clock time from which to count the cycles that should have been executed, and the
+	// number that have been
+	start := time.Now()
+	executed := 0
+	for {
+		if vm.closed() {
+			return nil
+		}
+		vm.mu.Lock()
+		if vm.pauseOnBlur {
+			vm.checkFocus()
+		}
+		vm.trackUptime(!vm.paused)
+		if vm.paused {
+			vm.mu.Unlock()
+			// Keep processing window events so we notice when focus returns, and hotkeys (e.g. to
+			// save the state) still work
+			if u, ok := vm.renderer.(inputUpdater); ok {
+				u.UpdateInput()
+			}
+			time.Sleep(pausedPollInterval)
+			lastTick = time.Now()
+			start, executed = time.Now(), 0
+			continue
+		}
+
+		// Execute however many cycles are due to keep up with the clock speed. If we've fallen
+		// too far behind (e.g. the host is too slow) drop the backlog rather than running flat
+		// out trying to catch up, the shortfall shows up in EmulationSpeed
+		due := int(time.Since(start).Seconds()*float64(vm.clockSpeed)) - executed
+		if limit := int(maxCatchUp.Seconds() * float64(vm.clockSpeed)); due > limit {
+			executed += due - limit
+			due = limit
+		}
+		// A watchpoint may pause partway through
+		for i := 0; i < due && !vm.paused; i++ {
+			if err := vm.runCycle(); err != nil {
+				vm.mu.Unlock()
+				return err
+			}
+		}
+		executed += due
+		vm.cycles += due
+
+		// Timers count down at 60Hz regardless of how quickly cycles are executed. Any drawing
+		// held back by the draw throttle is rendered at the same rate
+		if time.Since(lastTick) >= time.Second/timerFrequency {
+			vm.tickTimers()
+			vm.endFrame()
+			lastTick = time.Now()
+		}
+
+		vm.updateRates()
+		vm.mu.Unlock()
+
+		if due == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// RunFor runs the loaded ROM like Run, but stops after d of wall-clock time, e.g. to run a ROM for
+// 5 seconds then take a screenshot. It returns nil if the time runs out, or the same errors as Run
+// if the ROM stops or faults first. The limit is checked between batches of cycles, so it stops
+// promptly even if the ROM is in a tight loop or waiting for a key
+func (vm *VM) RunFor(d time.Duration) error {
+	vm.deadline = time.Now().Add(d)
+	defer func() { vm.deadline = time.Time{} }()
+	return vm.Run()
+}
+
+// startDelay waits out the frames set by WithStartDelayFrames before the ROM starts, rendering
+// the screen each frame. It reports whether the window was closed meanwhile
+func (vm *VM) startDelay() (closed bool) {
+	for i := 0; i < vm.startDelayFrames; i++ {
+		if vm.closed() {
+			return true
+		}
+		vm.mu.Lock()
+		vm.render()
+		vm.mu.Unlock()
+		time.Sleep(time.Second / timerFrequency)
+	}
+	return false
+}
+
+// runFrames runs the loaded ROM in lockstep with a 60Hz frame: each frame executes exactly
+// cyclesPerFrame cycles, then ticks the timers once, then renders
+func (vm *VM) runFrames() error {
+	ticker := time.NewTicker(time.Second / timerFrequency)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if vm.closed() {
+			return nil
+		}
+		vm.mu.Lock()
+		if vm.pauseOnBlur {
+			vm.checkFocus()
+		}
+		vm.trackUptime(!vm.paused)
+		paused := vm.paused
+		if !paused {
+			for i := 0; i < vm.cyclesPerFrame && !vm.paused; i++ {
+				if err := vm.runCycle(); err != nil {
+					vm.mu.Unlock()
+					return err
+				}
+			}
+			vm.cycles += vm.cyclesPerFrame
+			vm.tickTimers()
+			vm.endFrame()
+		}
+		vm.updateRates()
+		vm.mu.Unlock()
+
+		if u, ok := vm.renderer.(inputUpdater); ok && paused {
+			u.UpdateInput()
+		}
+	}
+	return nil
 }
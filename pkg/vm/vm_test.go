@@ -1 +1,2723 @@
 package vm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testInput is an Input with a fixed set of pressed keys
+type testInput []byte
+
+func (in testInput) IsPressed(key byte) bool {
+	for _, k := range in {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// newTestVM returns an initialised VM with no renderer attached
+func newTestVM() *VM {
+	vm := &VM{}
+	vm.Init(nil)
+	return vm
+}
+
+// execute places opcode in memory at the current PC and runs a single cycle
+func execute(vm *VM, opcode uint16) {
+	vm.memory[vm.pc] = byte(opcode >> 8)
+	vm.memory[vm.pc+1] = byte(opcode)
+	vm.executeCycle()
+}
+
+func TestOpcodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode uint16
+		setup  func(vm *VM)
+		check  func(t *testing.T, vm *VM)
+	}{
+		{
+			name:   "00E0 clears the screen",
+			opcode: 0x00E0,
+			setup: func(vm *VM) {
+				vm.pixels[3][4] = 1
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels != [64][64]byte{} {
+					t.Error("expected screen to be cleared")
+				}
+			},
+		},
+		{
+			name:   "00EE returns from a subroutine",
+			opcode: 0x00EE,
+			setup: func(vm *VM) {
+				vm.sp = 1
+				vm.stack[1] = 0x345
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{pc: addr(0x345)})
+				if vm.sp != 0 {
+					t.Errorf("expected sp 0, got %d", vm.sp)
+				}
+			},
+		},
+		{
+			name:   "1NNN jumps",
+			opcode: 0x1ABC,
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{pc: addr(0xABC)})
+			},
+		},
+		{
+			name:   "2NNN calls a subroutine",
+			opcode: 0x2ABC,
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{pc: addr(0xABC)})
+				if vm.sp != 1 || vm.stack[1] != 0x202 {
+					t.Errorf("expected return address 0x202 at sp 1, got %#x at sp %d", vm.stack[vm.sp], vm.sp)
+				}
+			},
+		},
+		{
+			name:   "3XNN skips if equal",
+			opcode: 0x3142,
+			setup:  func(vm *VM) { vm.variables[1] = 0x42 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x204)}) },
+		},
+		{
+			name:   "3XNN doesn't skip if not equal",
+			opcode: 0x3142,
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x202)}) },
+		},
+		{
+			name:   "4XNN skips if not equal",
+			opcode: 0x4142,
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x204)}) },
+		},
+		{
+			name:   "4XNN doesn't skip if equal",
+			opcode: 0x4142,
+			setup:  func(vm *VM) { vm.variables[1] = 0x42 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x202)}) },
+		},
+		{
+			name:   "5XY0 skips if registers equal",
+			opcode: 0x5120,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 7, 7 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x204)}) },
+		},
+		{
+			name:   "5XY0 doesn't skip if registers differ",
+			opcode: 0x5120,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 7, 8 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x202)}) },
+		},
+		{
+			name:   "5XY2 saves a register range",
+			opcode: 0x5132,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.index = 0x300
+				vm.variables[1], vm.variables[2], vm.variables[3] = 1, 2, 3
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x300: {1, 2, 3}}})
+				if vm.index != 0x300 {
+					t.Errorf("expected index to be unchanged, got %#x", vm.index)
+				}
+			},
+		},
+		{
+			name:   "5XY2 saves a register range in reverse",
+			opcode: 0x5312,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.index = 0x300
+				vm.variables[1], vm.variables[2], vm.variables[3] = 1, 2, 3
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x300: {3, 2, 1}}})
+			},
+		},
+		{
+			name:   "5XY3 loads a register range",
+			opcode: 0x5133,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.index = 0x300
+				copy(vm.memory[0x300:], []byte{1, 2, 3})
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 1, 2: 2, 3: 3}})
+			},
+		},
+		{
+			name:   "6XNN sets a register",
+			opcode: 0x6A42,
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xA: 0x42}})
+			},
+		},
+		{
+			name:   "7XNN adds to a register",
+			opcode: 0x7A02,
+			setup:  func(vm *VM) { vm.variables[0xA] = 0xFF },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xA: 0x01}})
+			},
+		},
+		{
+			name:   "8XY0 copies a register",
+			opcode: 0x8120,
+			setup:  func(vm *VM) { vm.variables[2] = 9 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 9}})
+			},
+		},
+		{
+			name:   "8XY1 ORs registers",
+			opcode: 0x8121,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 0x0F, 0xF0 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0xFF}})
+			},
+		},
+		{
+			name:   "8XY2 ANDs registers",
+			opcode: 0x8122,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 0x3C, 0x0F },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x0C}})
+			},
+		},
+		{
+			name:   "8XY3 XORs registers",
+			opcode: 0x8123,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 0x3C, 0x0F },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x33}})
+			},
+		},
+		{
+			name:   "8XY4 adds registers",
+			opcode: 0x8124,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 0x10, 0x22 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x32}})
+			},
+		},
+		{
+			name:   "8XY5 subtracts vy from vx",
+			opcode: 0x8125,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 0x22, 0x10 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x12}})
+			},
+		},
+		{
+			name:   "8XY6 shifts vy right into vx",
+			opcode: 0x8126,
+			setup:  func(vm *VM) { vm.variables[2] = 0x05 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x02, 0xF: 1}})
+			},
+		},
+		{
+			name:   "8XY7 subtracts vx from vy",
+			opcode: 0x8127,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 0x10, 0x22 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x12}})
+			},
+		},
+		{
+			name:   "8XYE shifts vy left into vx",
+			opcode: 0x812E,
+			setup:  func(vm *VM) { vm.variables[2] = 0x81 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x02, 0xF: 1}})
+			},
+		},
+		{
+			name:   "00E0 leaves vf alone",
+			opcode: 0x00E0,
+			setup:  func(vm *VM) { vm.variables[0xF] = 1 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 1}})
+			},
+		},
+		{
+			name:   "00E0 resets vf with the ClearResetsVF quirk",
+			opcode: 0x00E0,
+			setup: func(vm *VM) {
+				vm.quirks.ClearResetsVF = true
+				vm.variables[0xF] = 1
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 0}})
+			},
+		},
+		{
+			name:   "8XY1 resets vf with the LogicResetsVF quirk",
+			opcode: 0x8121,
+			setup: func(vm *VM) {
+				vm.quirks.LogicResetsVF = true
+				vm.variables[0xF] = 1
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 0}})
+			},
+		},
+		{
+			name:   "8XY6 shifts vx in place with the ShiftInPlace quirk",
+			opcode: 0x8126,
+			setup: func(vm *VM) {
+				vm.quirks.ShiftInPlace = true
+				vm.variables[1], vm.variables[2] = 0x08, 0x05
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x04}})
+			},
+		},
+		{
+			name:   "9XY0 skips if registers differ",
+			opcode: 0x9120,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 7, 8 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x204)}) },
+		},
+		{
+			name:   "9XY0 doesn't skip if registers equal",
+			opcode: 0x9120,
+			setup:  func(vm *VM) { vm.variables[1], vm.variables[2] = 7, 7 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x202)}) },
+		},
+		{
+			name:   "ANNN sets the index register",
+			opcode: 0xA123,
+			check: func(t *testing.T, vm *VM) {
+				if vm.index != 0x123 {
+					t.Errorf("expected index 0x123, got %#x", vm.index)
+				}
+			},
+		},
+		{
+			name:   "BNNN jumps with an offset of v0",
+			opcode: 0xB300,
+			setup:  func(vm *VM) { vm.variables[0], vm.variables[3] = 0x10, 0x20 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x310)}) },
+		},
+		{
+			name:   "BXNN jumps with an offset of vx with the JumpWithVX quirk",
+			opcode: 0xB300,
+			setup: func(vm *VM) {
+				vm.quirks.JumpWithVX = true
+				vm.variables[0], vm.variables[3] = 0x10, 0x20
+			},
+			check: func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x320)}) },
+		},
+		{
+			name:   "CXNN masks the random number",
+			opcode: 0xC100,
+			setup:  func(vm *VM) { vm.variables[1] = 0xFF },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0}})
+			},
+		},
+		{
+			name:   "CXNN uses the random source",
+			opcode: 0xC10F,
+			setup: func(vm *VM) {
+				WithRandomFunc(func() byte { return 0xAB })(vm)
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x0B}})
+			},
+		},
+		{
+			name:   "DXYN draws a sprite",
+			opcode: 0xD012,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				vm.memory[0x300] = 0x80
+				vm.memory[0x301] = 0x01
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels[0][0] == 0 || vm.pixels[7][1] == 0 {
+					t.Error("expected sprite pixels to be set")
+				}
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 0}})
+			},
+		},
+		{
+			name:   "DXYN sets the flag on collision",
+			opcode: 0xD011,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				vm.memory[0x300] = 0x80
+				vm.pixels[0][0] = 1
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels[0][0] != 0 {
+					t.Error("expected pixel to be erased")
+				}
+				AssertState(t, vm, StateSpec{collision: flagSet(true), pc: addr(0x202)})
+			},
+		},
+		{
+			name:   "DXYN with N = 0 draws nothing without XO-CHIP",
+			opcode: 0xD010,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				vm.memory[0x300] = 0xFF
+				vm.variables[0xF] = 1
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels != [64][64]byte{} {
+					t.Error("expected nothing to be drawn")
+				}
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 0}})
+			},
+		},
+		{
+			name:   "DXYN with N = 0 draws a 16x16 sprite with XO-CHIP",
+			opcode: 0xD010,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.index = 0x300
+				vm.memory[0x300] = 0x80 // Row 0, left half
+				vm.memory[0x301] = 0x01 // Row 0, right half
+				vm.memory[0x31F] = 0x01 // Row 15, right half
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels[0][0] == 0 || vm.pixels[15][0] == 0 || vm.pixels[15][15] == 0 {
+					t.Error("expected the corners of the 16x16 sprite to be drawn")
+				}
+				if vm.pixels[7][0] != 0 || vm.pixels[0][15] != 0 {
+					t.Error("expected the rest of the sprite to be blank")
+				}
+			},
+		},
+		{
+			name:   "FN01 selects planes",
+			opcode: 0xF201,
+			setup:  func(vm *VM) { vm.xoChip = true },
+			check: func(t *testing.T, vm *VM) {
+				if vm.selectedPlane != 2 {
+					t.Errorf("expected plane 2 to be selected, got %d", vm.selectedPlane)
+				}
+			},
+		},
+		{
+			name:   "DXYN draws to both selected planes",
+			opcode: 0xD011,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.selectedPlane = 3
+				vm.index = 0x300
+				vm.memory[0x300] = 0x80
+				vm.memory[0x301] = 0x40
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels[0][0] != 1 || vm.pixels[1][0] != 2 {
+					t.Errorf("expected plane 1 at (0, 0) and plane 2 at (1, 0), got %d and %d",
+						vm.pixels[0][0], vm.pixels[1][0])
+				}
+			},
+		},
+		{
+			name:   "00E0 clears only the selected planes",
+			opcode: 0x00E0,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.selectedPlane = 2
+				vm.pixels[0][0] = 3
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.pixels[0][0] != 1 {
+					t.Errorf("expected only plane 1 to remain, got %d", vm.pixels[0][0])
+				}
+			},
+		},
+		{
+			name:   "F002 loads the audio pattern",
+			opcode: 0xF002,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.index = 0x300
+				vm.memory[0x300] = 0xAA
+				vm.memory[0x30F] = 0x55
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.audioPattern[0] != 0xAA || vm.audioPattern[15] != 0x55 {
+					t.Errorf("unexpected audio pattern %x", vm.audioPattern)
+				}
+			},
+		},
+		{
+			name:   "FX3A sets the pitch",
+			opcode: 0xF13A,
+			setup: func(vm *VM) {
+				vm.xoChip = true
+				vm.variables[1] = 112
+			},
+			check: func(t *testing.T, vm *VM) {
+				if _, rate := vm.AudioPattern(); rate != 8000 {
+					t.Errorf("expected a playback rate of 8000Hz, got %v", rate)
+				}
+			},
+		},
+		{
+			name:   "FX07 reads the delay timer",
+			opcode: 0xF107,
+			setup:  func(vm *VM) { vm.delayTimer = 30 },
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 30}})
+			},
+		},
+		{
+			name:   "FX15 sets the delay timer",
+			opcode: 0xF115,
+			setup:  func(vm *VM) { vm.variables[1] = 30 },
+			check: func(t *testing.T, vm *VM) {
+				if vm.delayTimer != 30 {
+					t.Errorf("expected delay timer 30, got %d", vm.delayTimer)
+				}
+			},
+		},
+		{
+			name:   "FX18 sets the sound timer",
+			opcode: 0xF118,
+			setup:  func(vm *VM) { vm.variables[1] = 30 },
+			check: func(t *testing.T, vm *VM) {
+				if vm.soundTimer != 30 {
+					t.Errorf("expected sound timer 30, got %d", vm.soundTimer)
+				}
+			},
+		},
+		{
+			name:   "FX1E adds to the index register",
+			opcode: 0xF11E,
+			setup: func(vm *VM) {
+				vm.index = 0x100
+				vm.variables[1] = 0x20
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.index != 0x120 {
+					t.Errorf("expected index 0x120, got %#x", vm.index)
+				}
+			},
+		},
+		{
+			name:   "FX33 stores binary-coded decimal",
+			opcode: 0xF133,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				vm.variables[1] = 156
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x300: {1, 5, 6}}})
+			},
+		},
+		{
+			name:   "FX55 stores registers",
+			opcode: 0xFF55,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				for i := range vm.variables {
+					vm.variables[i] = byte(i + 1)
+				}
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{
+					memory: map[uint16][]byte{0x300: {1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+				})
+			},
+		},
+		{
+			name:   "EX9E skips if the key in vx is pressed",
+			opcode: 0xE19E,
+			setup: func(vm *VM) {
+				vm.input = testInput{0x5}
+				vm.variables[1] = 0x5
+			},
+			check: func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x204)}) },
+		},
+		{
+			name:   "EX9E does not skip if the key in vx is not pressed",
+			opcode: 0xE19E,
+			setup: func(vm *VM) {
+				vm.input = testInput{0x5}
+				vm.variables[1] = 0x6
+			},
+			check: func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x202)}) },
+		},
+		{
+			name:   "EXA1 skips if the key in vx is not pressed",
+			opcode: 0xE1A1,
+			setup:  func(vm *VM) { vm.variables[1] = 0x6 },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x204)}) },
+		},
+		{
+			name:   "FX0A repeats while a key held from before is down",
+			opcode: 0xF30A,
+			setup:  func(vm *VM) { vm.input = testInput{0xC} },
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x200)}) },
+		},
+		{
+			name:   "FX0A repeats without an input",
+			opcode: 0xF30A,
+			check:  func(t *testing.T, vm *VM) { AssertState(t, vm, StateSpec{pc: addr(0x200)}) },
+		},
+		{
+			name:   "FX55 stores only v0..vx",
+			opcode: 0xF155,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				vm.variables[0], vm.variables[1], vm.variables[2] = 1, 2, 3
+			},
+			check: func(t *testing.T, vm *VM) {
+				AssertState(t, vm, StateSpec{
+					memory: map[uint16][]byte{0x300: {1, 2, 0}},
+					index:  addr(0x300),
+				})
+			},
+		},
+		{
+			name:   "FX55 increments the index with the LoadStoreIncrementsIndex quirk",
+			opcode: 0xF155,
+			setup: func(vm *VM) {
+				vm.quirks.LoadStoreIncrementsIndex = true
+				vm.index = 0x300
+			},
+			check: func(t *testing.T, vm *VM) {
+				if vm.index != 0x302 {
+					t.Errorf("expected index 0x302, got %#x", vm.index)
+				}
+			},
+		},
+		{
+			name:   "FX65 loads registers",
+			opcode: 0xFF65,
+			setup: func(vm *VM) {
+				vm.index = 0x300
+				for i := 0; i < 16; i++ {
+					vm.memory[0x300+i] = byte(i + 1)
+				}
+			},
+			check: func(t *testing.T, vm *VM) {
+				for i := 0; i < 16; i++ {
+					AssertState(t, vm, StateSpec{registers: map[int]uint8{i: byte(i + 1)}})
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestVM()
+			if tt.setup != nil {
+				tt.setup(vm)
+			}
+			execute(vm, tt.opcode)
+			tt.check(t, vm)
+		})
+	}
+}
+
+func TestMalformedOpcodes(t *testing.T) {
+	for _, opcode := range []uint16{0x5121, 0x5122, 0x5123, 0x9121, 0xF101, 0xF002, 0xF13A} {
+		t.Run(fmt.Sprintf("%04X", opcode), func(t *testing.T) {
+			vm := newTestVM()
+			execute(vm, opcode)
+			if !errors.Is(vm.stopErr, ErrUnknownOpcode) {
+				t.Errorf("expected %04X to be rejected as unknown, got %v", opcode, vm.stopErr)
+			}
+			// The VM stays on the rejected instruction
+			AssertState(t, vm, StateSpec{pc: addr(0x200)})
+		})
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode uint16
+		setup  func(vm *VM)
+		err    error
+	}{
+		{"return with an empty stack", 0x00EE, func(vm *VM) {}, ErrStackUnderflow},
+		{"call with a full stack", 0x2300, func(vm *VM) { vm.sp = 15 }, ErrStackOverflow},
+		{"FX55 past the end of memory", 0xF355, func(vm *VM) { vm.index = 0xFFE }, ErrMemoryOutOfBounds},
+		{"FX65 past the end of memory", 0xF365, func(vm *VM) { vm.index = 0xFFE }, ErrMemoryOutOfBounds},
+		{"FX33 past the end of memory", 0xF033, func(vm *VM) { vm.index = 0xFFE }, ErrMemoryOutOfBounds},
+		{"DXYN past the end of memory", 0xD015, func(vm *VM) { vm.index = 0xFFC }, ErrMemoryOutOfBounds},
+		{"FX29 not implemented", 0xF029, func(vm *VM) {}, ErrNotImplemented},
+		{"unknown 00NN opcode", 0x00FA, func(vm *VM) {}, ErrUnknownOpcode},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := newTestVM()
+			tc.setup(vm)
+			vm.memory[0x200], vm.memory[0x201] = byte(tc.opcode>>8), byte(tc.opcode)
+			err := vm.RunCycles(1)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			var execErr *ExecError
+			if !errors.As(err, &execErr) || execErr.PC != 0x200 || execErr.Opcode != tc.opcode {
+				t.Errorf("expected an ExecError for %04X at 0x200, got %#v", tc.opcode, err)
+			}
+		})
+	}
+}
+
+func TestSpriteClipping(t *testing.T) {
+	vm := newTestVM()
+	vm.index = 0x300
+	vm.memory[0x300], vm.memory[0x301] = 0xFF, 0xFF
+	vm.variables[0], vm.variables[1] = 60, 31
+	execute(vm, 0xD012)
+	if vm.stopErr != nil {
+		t.Fatal(vm.stopErr)
+	}
+	for x := 0; x < 64; x++ {
+		want := byte(0)
+		if x >= 60 {
+			want = 1
+		}
+		if vm.pixels[x][31] != want {
+			t.Errorf("expected pixel (%d, 31) = %d, got %d", x, want, vm.pixels[x][31])
+		}
+		if vm.pixels[x][0] != 0 {
+			t.Errorf("expected the sprite not to wrap to (%d, 0)", x)
+		}
+	}
+}
+
+func TestSpriteWrap(t *testing.T) {
+	vm := newTestVM()
+	WithQuirks(Quirks{SpriteWrap: true})(vm)
+	vm.index = 0x300
+	vm.memory[0x300], vm.memory[0x301] = 0xFF, 0xFF
+	vm.variables[0], vm.variables[1] = 60, 31
+	execute(vm, 0xD012)
+	for x := 0; x < 64; x++ {
+		want := byte(0)
+		if x >= 60 || x < 4 {
+			want = 1
+		}
+		if vm.pixels[x][31] != want || vm.pixels[x][0] != want {
+			t.Errorf("expected pixels (%d, 31) and (%d, 0) = %d, got %d and %d",
+				x, x, want, vm.pixels[x][31], vm.pixels[x][0])
+		}
+	}
+}
+
+// TestShiftFlag checks that vf is the bit shifted out of the register the ShiftInPlace quirk
+// selects as the source, never the other register's, and is cleared as well as set
+func TestShiftFlag(t *testing.T) {
+	tests := []struct {
+		opcode       uint16
+		shiftInPlace bool
+		vx, vy       uint8
+		result, flag uint8
+	}{
+		// vy is shifted, and only vy's bit is 1
+		{0x8126, false, 0x02, 0x03, 0x01, 1},
+		{0x812E, false, 0x01, 0x81, 0x02, 1},
+		// vy is shifted, and only vx's bit is 1
+		{0x8126, false, 0x03, 0x02, 0x01, 0},
+		{0x812E, false, 0x81, 0x01, 0x02, 0},
+		// vx is shifted, and only vx's bit is 1
+		{0x8126, true, 0x03, 0x02, 0x01, 1},
+		{0x812E, true, 0x81, 0x01, 0x02, 1},
+		// vx is shifted, and only vy's bit is 1
+		{0x8126, true, 0x02, 0x03, 0x01, 0},
+		{0x812E, true, 0x01, 0x81, 0x02, 0},
+	}
+	for _, tc := range tests {
+		vm := newTestVM()
+		vm.quirks.ShiftInPlace = tc.shiftInPlace
+		vm.variables[1], vm.variables[2] = tc.vx, tc.vy
+		vm.variables[0xF] = 1 - tc.flag
+		execute(vm, tc.opcode)
+		if vm.variables[1] != tc.result || vm.variables[0xF] != tc.flag {
+			t.Errorf("%04X (ShiftInPlace %v) with vx=%#02x vy=%#02x: expected vx=%#02x vf=%d, got vx=%#02x vf=%d",
+				tc.opcode, tc.shiftInPlace, tc.vx, tc.vy, tc.result, tc.flag, vm.variables[1], vm.variables[0xF])
+		}
+	}
+
+	// With vx = vf the flag overwrites the result
+	vm := newTestVM()
+	vm.variables[2] = 0x03
+	execute(vm, 0x8F26)
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 1}})
+}
+
+func TestRegisterAccess(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.SetRegister(0xF, 0x42); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := vm.Register(0xF); err != nil || v != 0x42 {
+		t.Errorf("expected vF = 0x42, got %#x (err %v)", v, err)
+	}
+	for _, i := range []int{-1, 16} {
+		if _, err := vm.Register(i); err == nil {
+			t.Errorf("expected an error reading register %d", i)
+		}
+		if err := vm.SetRegister(i, 0); err == nil {
+			t.Errorf("expected an error writing register %d", i)
+		}
+	}
+}
+
+func TestRandomSource(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil, WithRandomSource(bytes.NewReader([]byte{0x12, 0x34})))
+	execute(vm, 0xC1FF)
+	execute(vm, 0xC2FF)
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x12, 2: 0x34}})
+
+	// Once the source runs out, CXNN fails rather than panicking
+	err := vm.ExecuteOpcode(0xC3FF)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || !errors.Is(err, ErrRandomSource) {
+		t.Errorf("expected an ExecError wrapping ErrRandomSource, got %v", err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{3: 0}, pc: addr(0x204)})
+}
+
+func TestLoadROMAt(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMAt([]byte{1, 2, 3}, 0x100); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x100: {1, 2, 3}}})
+
+	if err := vm.LoadROMAt(make([]byte, 4), 0xFFD); err == nil {
+		t.Error("expected an error loading past the end of memory")
+	}
+	if err := vm.LoadROMAt(make([]byte, 3), 0xFFD); err != nil {
+		t.Errorf("expected loading up to the end of memory to succeed, got %v", err)
+	}
+}
+
+func TestDrawWithFlagAsCoordinate(t *testing.T) {
+	tests := []struct {
+		name      string
+		collision bool
+	}{
+		{"collision", true},
+		{"no collision", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := newTestVM()
+			vm.index = 0x300
+			vm.memory[0x300] = 0x80
+			vm.variables[0xF] = 2
+			if tt.collision {
+				vm.pixels[2][0] = 1
+			}
+
+			// Draw a single pixel at (vF, v0) = (2, 0)
+			execute(vm, 0xDF01)
+
+			if tt.collision {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 1}})
+				if vm.pixels[2][0] != 0 {
+					t.Error("expected the pixel at (2, 0) to be erased")
+				}
+			} else {
+				AssertState(t, vm, StateSpec{registers: map[int]uint8{0xF: 0}})
+				if vm.pixels[2][0] == 0 {
+					t.Error("expected the pixel at (2, 0) to be drawn")
+				}
+			}
+		})
+	}
+}
+
+func TestSpriteAt(t *testing.T) {
+	vm := newTestVM()
+	copy(vm.memory[0x300:], []byte{0x81, 0x3C})
+
+	sprite := vm.SpriteAt(0x300, 2)
+	want := [][]bool{
+		{true, false, false, false, false, false, false, true},
+		{false, false, true, true, true, true, false, false},
+	}
+	if fmt.Sprint(sprite) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, sprite)
+	}
+	if rows := len(vm.SpriteAt(0xFFF, 5)); rows != 1 {
+		t.Errorf("expected sprite to be truncated at the end of memory, got %d rows", rows)
+	}
+}
+
+func TestMemoryMap(t *testing.T) {
+	vm := newTestVM()
+	vm.romSize = 132
+	want := "0x000-0x1FF  interpreter/font    512 bytes\n" +
+		"0x200-0x283  program (ROM)       132 bytes\n" +
+		"0x284-0xFFF  free               3452 bytes\n"
+	if got := vm.MemoryMap(); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestExecHooks(t *testing.T) {
+	vm := newTestVM()
+	var calls []string
+	vm.SetPreExecHook(func(vm *VM) {
+		calls = append(calls, fmt.Sprintf("pre %#x", vm.pc))
+		vm.variables[1] = 0x10
+	})
+	vm.SetPostExecHook(func(vm *VM) {
+		calls = append(calls, fmt.Sprintf("post %#x", vm.pc))
+	})
+
+	// The pre-exec hook's write to v1 should be visible to the instruction
+	execute(vm, 0x7101)
+
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x11}})
+	if want := "[pre 0x200 post 0x202]"; fmt.Sprint(calls) != want {
+		t.Errorf("expected hook calls %s, got %v", want, calls)
+	}
+}
+
+func TestFrameHash(t *testing.T) {
+	vm := newTestVM()
+	blank := vm.FrameHash()
+	if vm.FrameHash() != blank {
+		t.Fatal("expected the hash of an unchanged screen to be stable")
+	}
+	vm.pixels[3][4] = 1
+	if vm.FrameHash() == blank {
+		t.Error("expected the hash to change when a pixel changes")
+	}
+	vm.pixels[3][4] = 0
+	if vm.FrameHash() != blank {
+		t.Error("expected the hash to return to the blank screen's hash")
+	}
+}
+
+func TestMinSoundDuration(t *testing.T) {
+	vm := newTestVM()
+	WithMinSoundDuration(50 * time.Millisecond)(vm)
+	var events []bool
+	vm.SetSoundHook(func(active bool) { events = append(events, active) })
+
+	vm.setSoundTimer(1)
+	// 50ms rounds up to 3 ticks, so the beep outlasts the 1 tick sound timer
+	for i := 0; i < 2; i++ {
+		vm.tickTimers()
+		if len(events) != 1 {
+			t.Fatalf("expected the beep to still be playing after %d ticks, got events %v", i+1, events)
+		}
+	}
+	vm.tickTimers()
+	if len(events) != 2 || events[0] != true || events[1] != false {
+		t.Errorf("expected the beep to start then stop after 3 ticks, got events %v", events)
+	}
+}
+
+func TestInitialTimers(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil, WithDelayTimer(5), WithSoundTimer(2))
+	for want := uint8(5); want > 2; want-- {
+		execute(vm, 0xF107)
+		AssertState(t, vm, StateSpec{registers: map[int]uint8{1: want}})
+		vm.tickTimers()
+	}
+	if vm.soundTimer != 0 {
+		t.Errorf("expected the sound timer to have run out, got %d", vm.soundTimer)
+	}
+
+	// The preset beep starts once the VM runs, so the audio backend sees it start and stop
+	spy := &spyBeeper{}
+	vm = &VM{}
+	vm.Init(nil, WithSoundTimer(2), WithAudio(spy))
+	if len(spy.calls) != 0 {
+		t.Errorf("expected no beep before running, got %v", spy.calls)
+	}
+	if err := vm.RunCycles(3 * defaultCyclesPerFrame); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(spy.calls, ","); got != "start 440,stop" {
+		t.Errorf("expected the beep to start and stop, got %s", got)
+	}
+}
+
+// spyBeeper records the calls made to an AudioBeeper
+type spyBeeper struct {
+	calls []string
+}
+
+func (b *spyBeeper) Start(freq float64) {
+	b.calls = append(b.calls, fmt.Sprintf("start %v", freq))
+}
+
+func (b *spyBeeper) Stop() {
+	b.calls = append(b.calls, "stop")
+}
+
+func TestKeyWait(t *testing.T) {
+	vm := newTestVM()
+	spy := &spyBeeper{}
+	var keys testInput
+	WithInput(&keys)(vm)
+	WithAudio(spy)(vm)
+	rom := []byte{
+		0x60, 0x02, // LD V0, 0x02
+		0xF0, 0x18, // LD ST, V0
+		0xF3, 0x0A, // LD V3, K
+		0x12, 0x06, // JP 0x206
+	}
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+
+	// The timers keep counting down while FX0A waits, so the beep stops
+	if err := vm.RunCycles(5 * defaultCyclesPerFrame); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x204)})
+	if vm.soundTimer != 0 || strings.Join(spy.calls, ",") != "start 440,stop" {
+		t.Errorf("expected the beep to start and stop while waiting, got sound timer %d and %v",
+			vm.soundTimer, spy.calls)
+	}
+
+	// A key only counts once released
+	keys = testInput{0x7}
+	if err := vm.RunCycles(10); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x204)})
+	keys = nil
+	if err := vm.RunCycles(2); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{3: 0x7}, pc: addr(0x206)})
+}
+
+func TestKeyRepeat(t *testing.T) {
+	vm := newTestVM()
+	WithInput(testInput{0x9})(vm)
+	WithKeyRepeat(time.Millisecond)(vm)
+	execute(vm, 0xF30A)
+	AssertState(t, vm, StateSpec{pc: addr(0x200)})
+	time.Sleep(2 * time.Millisecond)
+	execute(vm, 0xF30A)
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{3: 0x9}, pc: addr(0x202)})
+}
+
+func TestAudio(t *testing.T) {
+	vm := newTestVM()
+	spy := &spyBeeper{}
+	WithAudio(spy)(vm)
+
+	// FX18 starts the beep, and it stops when the sound timer runs out
+	vm.variables[0] = 2
+	execute(vm, 0xF018)
+	vm.tickTimers()
+	vm.tickTimers()
+	// Pausing silences a beep, and resuming restarts it
+	vm.setSoundTimer(5)
+	vm.Pause()
+	vm.Resume()
+	// Rewriting the timer while sounding doesn't restart it
+	vm.setSoundTimer(3)
+	vm.setSoundTimer(0)
+
+	expected := "start 440, stop, start 440, stop, start 440, stop"
+	if got := strings.Join(spy.calls, ", "); got != expected {
+		t.Errorf("expected calls %q, got %q", expected, got)
+	}
+}
+
+// spySampler records the samples given to an AudioSampler
+type spySampler struct {
+	spyBeeper
+	samples []float32
+}
+
+func (s *spySampler) PlaySamples(samples []float32) {
+	s.samples = append(s.samples, samples...)
+}
+
+func TestAudioSamples(t *testing.T) {
+	vm := newTestVM()
+	spy := &spySampler{}
+	WithAudio(spy)(vm)
+	WithAudioSamples(44100)(vm)
+
+	vm.setSoundTimer(10)
+	for i := 0; i < 12; i++ {
+		vm.tickTimers()
+	}
+	// 10 ticks is 1/6 of a second
+	if len(spy.samples) != 7350 {
+		t.Fatalf("expected 7350 samples, got %d", len(spy.samples))
+	}
+	// A 440Hz square wave is high for the first 50 samples of each ~100
+	if spy.samples[0] != 1 || spy.samples[49] != 1 || spy.samples[51] != -1 {
+		t.Errorf("expected a square wave, got %v", spy.samples[:60])
+	}
+
+	// XO-CHIP loops the audio pattern, by default at 4000 bits per second
+	vm = newTestVM()
+	spy = &spySampler{}
+	WithAudio(spy)(vm)
+	WithAudioSamples(4000)(vm)
+	WithXOChip(true)(vm)
+	vm.audioPattern[0] = 0xA0
+	vm.setSoundTimer(1)
+	vm.tickTimers()
+	want := []float32{1, -1, 1, -1, -1}
+	if len(spy.samples) != 66 || fmt.Sprint(spy.samples[:5]) != fmt.Sprint(want) {
+		t.Errorf("expected 66 samples starting %v, got %d starting %v", want, len(spy.samples), spy.samples[:5])
+	}
+}
+
+func TestInstructionsPerFrameStats(t *testing.T) {
+	vm := newTestVM()
+	if vm.InstructionsPerFrameStats() != nil {
+		t.Error("expected no stats unless enabled")
+	}
+	WithFrameStats(true)(vm)
+	WithCyclesPerFrame(4)(vm)
+	// Clear the screen every other frame, so after the first frame 8 instructions are executed
+	// between renders
+	rom := []byte{0x00, 0xE0, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x12, 0x00}
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(32); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{4: 1, 8: 3}
+	if got := vm.InstructionsPerFrameStats(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected stats %v, got %v", want, got)
+	}
+}
+
+func TestStrictOpcodes(t *testing.T) {
+	for _, opcode := range []uint16{0x0123, 0x8128, 0x812F, 0x0230} {
+		vm := newTestVM()
+		execute(vm, opcode)
+		if vm.stopErr != nil {
+			t.Errorf("expected %04X to be ignored without strict opcodes, got %v", opcode, vm.stopErr)
+		}
+
+		vm = newTestVM()
+		WithStrictOpcodes(true)(vm)
+		execute(vm, opcode)
+		if !errors.Is(vm.stopErr, ErrUnknownOpcode) {
+			t.Errorf("expected %04X to be rejected with strict opcodes, got %v", opcode, vm.stopErr)
+		}
+		AssertState(t, vm, StateSpec{pc: addr(0x200)})
+	}
+
+	vm := newTestVM()
+	WithStrictOpcodes(true)(vm)
+	WithXOChip(true)(vm)
+	execute(vm, 0xF001)
+	execute(vm, 0x6105)
+	if vm.stopErr != nil {
+		t.Errorf("expected supported opcodes to execute, got %v", vm.stopErr)
+	}
+}
+
+func TestFramebufferEncoding(t *testing.T) {
+	vm := newTestVM()
+	vm.pixels[0][0] = 1
+	vm.pixels[9][0] = 2
+	vm.pixels[63][31] = 3
+	data := vm.EncodeFramebuffer()
+	if len(data) != 256 {
+		t.Fatalf("expected 256 bytes, got %d", len(data))
+	}
+	if data[0] != 0x80 || data[1] != 0x40 || data[255] != 0x01 {
+		t.Errorf("expected bytes 0x80 0x40 ... 0x01, got %#02x %#02x ... %#02x", data[0], data[1], data[255])
+	}
+
+	other := newTestVM()
+	if err := other.DecodeFramebuffer(data); err != nil {
+		t.Fatal(err)
+	}
+	if other.pixels[0][0] != 1 || other.pixels[9][0] != 1 || other.pixels[63][31] != 1 || other.pixels[1][0] != 0 {
+		t.Error("expected the lit pixels to be restored in plane 1")
+	}
+	if !other.dirty {
+		t.Error("expected the restored screen to be redrawn")
+	}
+	if err := other.DecodeFramebuffer(data[:255]); err == nil {
+		t.Error("expected an error decoding a truncated framebuffer")
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x61, 0x01, 0x62, 0x02, 0x63, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	vm.AddBreakpoint(0x202)
+	for i := 0; i < 2; i++ {
+		if err := vm.runCycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !vm.paused {
+		t.Fatal("expected the VM to pause at the breakpoint")
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{2: 0}, pc: addr(0x202)})
+
+	// Continuing executes the instruction rather than hitting the breakpoint again
+	vm.Resume()
+	vm.runCycle()
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{2: 0x02}})
+	if vm.paused {
+		t.Error("expected the VM to continue past the breakpoint")
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x61, 0x2A, 0xA2, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := vm.StartDebugServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(cmd string) string {
+		fmt.Fprintln(conn, cmd)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	for _, tc := range []struct{ cmd, want string }{
+		{"step", "ok 0x0202"},
+		{"regs", "ok pc=0x0202 i=0x0000 sp=0 dt=0 st=0 v0=0x00 v1=0x2a v2=0x00 v3=0x00 v4=0x00 " +
+			"v5=0x00 v6=0x00 v7=0x00 v8=0x00 v9=0x00 va=0x00 vb=0x00 vc=0x00 vd=0x00 ve=0x00 vf=0x00"},
+		{"mem 0x200 4", "ok 612aa200"},
+		{"mem 0xFFF 2", "error memory access out of bounds: 2 bytes at 0x0fff"},
+		{"break 0x300", "ok"},
+		{"break", "error break takes 1 arguments"},
+		{"frame", "ok " + strings.Repeat("00", 256)},
+		{"bogus", "error unknown command"},
+	} {
+		if got := send(tc.cmd); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.cmd, tc.want, got)
+		}
+	}
+	if !vm.breakpoints[0x300] {
+		t.Error("expected a breakpoint to be set")
+	}
+
+	if got := send("stream"); got != "ok" {
+		t.Fatalf("stream: expected ok, got %q", got)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "frame ") {
+		t.Errorf("expected a streamed frame, got %q", line)
+	}
+}
+
+func TestCheats(t *testing.T) {
+	vm := newTestVM()
+	vm.AddCheat(0x300, 3)
+	vm.index = 0x300
+	execute(vm, 0x6000)
+	execute(vm, 0xF055) // The ROM writes 0, but reads back 3
+	execute(vm, 0xF065)
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{0: 3}})
+
+	if got := vm.Cheats(); len(got) != 1 || got[0x300] != 3 {
+		t.Errorf("expected the cheat to be listed, got %v", got)
+	}
+	vm.RemoveCheat(0x300)
+	execute(vm, 0x6000)
+	execute(vm, 0xF055)
+	execute(vm, 0xF065)
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{0: 0}})
+}
+
+func TestInputLog(t *testing.T) {
+	vm := newTestVM()
+	if vm.InputLog() != nil {
+		t.Error("expected no input log unless enabled")
+	}
+	var buf bytes.Buffer
+	var keys testInput
+	WithInput(&keys)(vm)
+	WithInputLog(&buf)(vm)
+
+	execute(vm, 0x6000)
+	keys = testInput{5}
+	execute(vm, 0x6000)
+	execute(vm, 0x6000)
+	keys = nil
+	execute(vm, 0x6000)
+
+	events := vm.InputLog()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v", events)
+	}
+	if events[0].Key != 5 || !events[0].Pressed || events[0].Cycle != 1 {
+		t.Errorf("expected key 5 pressed at cycle 1, got %+v", events[0])
+	}
+	if events[1].Key != 5 || events[1].Pressed || events[1].Cycle != 3 {
+		t.Errorf("expected key 5 released at cycle 3, got %+v", events[1])
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 ||
+		!strings.HasSuffix(lines[0], "cycle 1 key 5 down") {
+		t.Errorf("expected the events written to the log, got %q", buf.String())
+	}
+}
+
+func TestIsBeeping(t *testing.T) {
+	vm := newTestVM()
+	if vm.IsBeeping() {
+		t.Error("expected no beep initially")
+	}
+	vm.variables[1] = 2
+	execute(vm, 0xF118)
+	if !vm.IsBeeping() {
+		t.Error("expected a beep after setting the sound timer")
+	}
+	vm.Pause()
+	if vm.IsBeeping() {
+		t.Error("expected no beep while paused")
+	}
+	vm.Resume()
+	vm.tickTimers()
+	vm.tickTimers()
+	if vm.IsBeeping() {
+		t.Error("expected the beep to stop when the sound timer reaches 0")
+	}
+}
+
+func TestCoverageReport(t *testing.T) {
+	vm := newTestVM()
+	if vm.CoverageReport() != nil {
+		t.Error("expected no report without coverage tracking")
+	}
+
+	WithCoverage(true)(vm)
+	for _, opcode := range []uint16{0x6105, 0x6207, 0x8124, 0x00E0} {
+		execute(vm, opcode)
+	}
+	report := vm.CoverageReport()
+	for _, form := range []string{"6XNN", "8XY4", "00E0"} {
+		if !report[form] {
+			t.Errorf("expected %s to be covered, got %v", form, report)
+		}
+	}
+	if len(report) != 3 {
+		t.Errorf("expected 3 forms to be covered, got %v", report)
+	}
+}
+
+func TestOpcodeForm(t *testing.T) {
+	tests := map[uint16]string{
+		0x00EE: "00EE", 0x0123: "0NNN", 0x1234: "1NNN", 0x3A42: "3XNN", 0x5120: "5XY0",
+		0x812E: "8XYE", 0xD125: "DXYN", 0xE19E: "EX9E", 0xF365: "FX65", 0xF201: "FN01",
+		0xF002: "F002", 0x00FB: "00FB", 0x0230: "0230", 0x0000: "0NNN",
+	}
+	for opcode, want := range tests {
+		if got := opcodeForm(opcode); got != want {
+			t.Errorf("opcodeForm(%#04x) = %q, want %q", opcode, got, want)
+		}
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	// Every opcode in the registry has a handler
+	vm := newTestVM()
+	WithXOChip(true)(vm)
+	for _, info := range SupportedOpcodes() {
+		if vm.handler(info.Form) == nil {
+			t.Errorf("expected a handler for %s", info.Form)
+		}
+	}
+}
+
+func TestWithHandler(t *testing.T) {
+	vm := newTestVM()
+	scrolled := 0
+	WithHandler("00FB", func(vm *VM, in Instruction) error {
+		scrolled++
+		return nil
+	})(vm)
+	// Replace 6XNN with a version that sets vx to nn + 1
+	WithHandler("6XNN", func(vm *VM, in Instruction) error {
+		vm.setRegister(in.X, uint8(in.NN)+1)
+		return nil
+	})(vm)
+
+	execute(vm, 0x00FB)
+	if scrolled != 1 || vm.stopErr != nil {
+		t.Errorf("expected the custom 00FB handler to run, got error %v", vm.stopErr)
+	}
+	execute(vm, 0x6105)
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x06}})
+	// Other 00NN opcodes are still unknown
+	execute(vm, 0x00FC)
+	if !errors.Is(vm.stopErr, ErrUnknownOpcode) {
+		t.Errorf("expected 00FC to be unknown, got %v", vm.stopErr)
+	}
+}
+
+func TestCopyStateFrom(t *testing.T) {
+	original := newTestVM()
+	if err := original.LoadROMAt([]byte{0x61, 0x05, 0x71, 0x01, 0x12, 0x02}, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	original.RunCycles(2)
+	original.pixels[1][2] = 1
+
+	clone := newTestVM()
+	clone.CopyStateFrom(original)
+	AssertState(t, clone, StateSpec{registers: map[int]uint8{1: 0x06}, pc: addr(0x204)})
+	if clone.pixels[1][2] != 1 {
+		t.Error("expected the pixel buffer to be copied")
+	}
+
+	// Running the clone mustn't affect the original
+	clone.RunCycles(2)
+	AssertState(t, clone, StateSpec{registers: map[int]uint8{1: 0x07}})
+	AssertState(t, original, StateSpec{registers: map[int]uint8{1: 0x06}})
+	clone.memory[0x300] = 0xAA
+	if original.memory[0x300] != 0 {
+		t.Error("expected memory to be copied, not shared")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	vm := newTestVM()
+	WithPanicRecovery(true)(vm)
+	execute(vm, 0x6000) // Leave the PC at 0x202
+	vm.memory[0x202], vm.memory[0x203] = 0x61, 0x05
+	vm.SetPostExecHook(func(*VM) { panic("boom") })
+	err := vm.runCycle()
+	if err == nil {
+		t.Fatal("expected an error for the panic")
+	}
+	for _, s := range []string{"6105", "0x0202", "boom"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected the error to identify the opcode, PC and panic, got %q", err)
+		}
+	}
+
+	WithPanicRecovery(false)(vm)
+	vm.pc = 0x202
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic without recovery")
+		}
+	}()
+	vm.runCycle()
+}
+
+func TestVerifyTrace(t *testing.T) {
+	rom := []byte{
+		0x61, 0x05, // V1 = 5
+		0xA3, 0x00, // I = 0x300
+		0xF1, 0x55, // Store V0-V1 at I
+		0x71, 0x01, // V1 += 1
+		0x12, 0x06, // Loop back to V1 += 1
+	}
+	traced := newTestVM()
+	var trace bytes.Buffer
+	WithTrace(&trace)(traced)
+	if err := traced.LoadROMAt(rom, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	traced.RunCycles(20)
+
+	replay := newTestVM()
+	if err := replay.LoadROMAt(rom, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.VerifyTrace(bytes.NewReader(trace.Bytes())); err != nil {
+		t.Errorf("expected the same ROM to reproduce the trace, got %v", err)
+	}
+
+	// A ROM that loads a different value diverges at the first instruction
+	rom[1] = 0x06
+	diverged := newTestVM()
+	if err := diverged.LoadROMAt(rom, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	err := diverged.VerifyTrace(bytes.NewReader(trace.Bytes()))
+	if err == nil || !strings.HasPrefix(err.Error(), "cycle 0:") {
+		t.Errorf("expected verification to fail at cycle 0, got %v", err)
+	}
+}
+
+func TestCompareRun(t *testing.T) {
+	rom := []byte{
+		0x61, 0x05, // V1 = 5
+		0x62, 0x04, // V2 = 4
+		0x81, 0x26, // V1 = V2 >> 1, or V1 >> 1 with the ShiftInPlace quirk
+		0x12, 0x06, // Loop forever
+	}
+	newVM := func(opts ...Option) *VM {
+		vm := &VM{}
+		vm.Init(nil, opts...)
+		if err := vm.LoadROMBytes(rom); err != nil {
+			t.Fatal(err)
+		}
+		return vm
+	}
+
+	cycle, err := newVM().CompareRun(NewVMTracer(newVM()), 100)
+	if cycle != -1 || err != nil {
+		t.Errorf("expected identical VMs to agree, diverged at cycle %d: %v", cycle, err)
+	}
+
+	shifted := newVM(WithQuirks(Quirks{ShiftInPlace: true}))
+	cycle, err = shifted.CompareRun(NewVMTracer(newVM()), 100)
+	if cycle != 2 || err == nil {
+		t.Errorf("expected the ShiftInPlace quirk to diverge at cycle 2, got %d: %v", cycle, err)
+	}
+
+	// A recorded trace agrees until it runs out
+	var trace bytes.Buffer
+	traced := newVM(WithTrace(&trace))
+	traced.RunCycles(3)
+	cycle, err = newVM().CompareRun(NewTraceReader(&trace), 100)
+	if cycle != -1 || err != nil {
+		t.Errorf("expected the trace to agree, diverged at cycle %d: %v", cycle, err)
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.StepBack(); err == nil {
+		t.Error("expected an error stepping back without history")
+	}
+
+	WithHistory(2)(vm)
+	if err := vm.LoadROMAt([]byte{0x61, 0x05, 0x71, 0x01, 0x71, 0x01}, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		vm.Step()
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x07}})
+
+	if err := vm.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x06}, pc: addr(0x204)})
+	if err := vm.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x05}, pc: addr(0x202)})
+	// Only 2 instructions of history were kept
+	if err := vm.StepBack(); err == nil {
+		t.Error("expected an error once the history is used up")
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x202)})
+
+	// History recorded after stepping back is undone in turn
+	vm.Step()
+	if err := vm.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x05}, pc: addr(0x202)})
+
+	// A negative depth disables history rather than panicking
+	WithHistory(-1)(vm)
+	vm.Step()
+	if err := vm.StepBack(); err == nil {
+		t.Error("expected an error stepping back with a negative history depth")
+	}
+}
+
+func TestRestoreBeep(t *testing.T) {
+	vm := newTestVM()
+	spy := &spyBeeper{}
+	WithAudio(spy)(vm)
+	WithHistory(1)(vm)
+	vm.variables[0] = 10
+	execute(vm, 0xF018)
+	beeping := vm.Snapshot()
+
+	// Stepping back to before the beep started stops it, and restoring a snapshot taken during
+	// it starts it again
+	if err := vm.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	vm.Restore(beeping)
+	if got := strings.Join(spy.calls, ","); got != "start 440,stop,start 440" {
+		t.Errorf("expected the beep to start, stop and start again, got %s", got)
+	}
+
+	// Restoring while paused leaves the beep to Resume
+	vm.Pause()
+	vm.Reset()
+	vm.Restore(beeping)
+	vm.Resume()
+	if got := strings.Join(spy.calls, ","); got != "start 440,stop,start 440,stop,start 440" {
+		t.Errorf("expected the beep to start again only on resuming, got %s", got)
+	}
+}
+
+func TestOverflowHook(t *testing.T) {
+	vm := newTestVM()
+	type overflow struct {
+		x    int
+		a, b uint8
+		pc   uint16
+	}
+	var got []overflow
+	vm.SetOverflowHook(func(x int, a, b uint8, pc uint16) { got = append(got, overflow{x, a, b, pc}) })
+
+	vm.variables[1], vm.variables[2] = 0xF0, 0x20
+	execute(vm, 0x710F) // 0xF0 + 0x0F doesn't overflow
+	execute(vm, 0x7101) // 0xFF + 0x01 does
+	execute(vm, 0x8124) // 0x00 + 0x20 doesn't
+	vm.variables[2] = 0xF0
+	execute(vm, 0x8124) // 0x20 + 0xF0 does
+	want := []overflow{{1, 0xFF, 0x01, 0x202}, {1, 0x20, 0xF0, 0x206}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected overflows %v, got %v", want, got)
+	}
+}
+
+func TestBorrowHook(t *testing.T) {
+	vm := newTestVM()
+	type borrow struct {
+		x    int
+		a, b uint8
+		pc   uint16
+	}
+	var got []borrow
+	vm.SetBorrowHook(func(x int, a, b uint8, pc uint16) { got = append(got, borrow{x, a, b, pc}) })
+
+	vm.variables[1], vm.variables[2] = 0x05, 0x05
+	execute(vm, 0x8125) // 0x05 - 0x05 doesn't borrow
+	execute(vm, 0x8125) // 0x00 - 0x05 does
+	execute(vm, 0x8127) // 0x05 - 0xFB does
+	vm.variables[1] = 0x01
+	execute(vm, 0x8127) // 0x05 - 0x01 doesn't
+	want := []borrow{{1, 0x00, 0x05, 0x202}, {1, 0x05, 0xFB, 0x204}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected borrows %v, got %v", want, got)
+	}
+}
+
+func TestWatchRegister(t *testing.T) {
+	vm := newTestVM()
+	type change struct {
+		reg      int
+		old, new uint8
+		pc       uint16
+	}
+	var got []change
+	vm.SetRegisterWatchHook(func(reg int, old, new uint8, pc uint16) {
+		got = append(got, change{reg, old, new, pc})
+	})
+	if err := vm.WatchRegister(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{-1, 16} {
+		if err := vm.WatchRegister(i); err == nil {
+			t.Errorf("expected an error watching register %d", i)
+		}
+		if err := vm.UnwatchRegister(i); err == nil {
+			t.Errorf("expected an error unwatching register %d", i)
+		}
+	}
+	if vm.watched[0] {
+		t.Error("expected an out of range register not to watch V0")
+	}
+
+	execute(vm, 0x6105) // Not watched
+	execute(vm, 0x6300) // Watched, but unchanged
+	if len(got) != 0 || vm.paused {
+		t.Fatalf("expected no watchpoint hit, got %v", got)
+	}
+	execute(vm, 0x7302)
+	want := []change{{3, 0x00, 0x02, 0x204}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected changes %v, got %v", want, got)
+	}
+	if !vm.paused {
+		t.Error("expected a watchpoint hit to pause the VM")
+	}
+
+	if err := vm.UnwatchRegister(3); err != nil {
+		t.Fatal(err)
+	}
+	execute(vm, 0x7302)
+	if len(got) != 1 {
+		t.Errorf("expected no change reported after unwatching, got %v", got[1:])
+	}
+}
+
+func TestHires(t *testing.T) {
+	// HIRES startup code jumping to 0x260, then the program at 0x2C0
+	rom := make([]byte, hiresEntry-0x200+2)
+	rom[0], rom[1] = 0x12, 0x60
+	rom[hiresEntry-0x200], rom[hiresEntry-0x200+1] = 0x02, 0x30
+
+	vm := newTestVM()
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	if vm.hires {
+		t.Error("expected HIRES mode to be off by default")
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x200)})
+
+	vm = newTestVM()
+	WithHires(HiresDetect)(vm)
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	if !vm.hires {
+		t.Fatal("expected the HIRES startup code to be detected")
+	}
+	AssertState(t, vm, StateSpec{pc: addr(hiresEntry)})
+
+	// Sprites wrap at 64 rows, not 32
+	vm.index = 0x300
+	vm.memory[0x300] = 0x80
+	vm.variables[1] = 40
+	execute(vm, 0xD011)
+	if vm.pixels[0][40] == 0 {
+		t.Error("expected a pixel drawn at (0, 40)")
+	}
+	vm.pc = hiresEntry
+	vm.executeCycle()
+	if vm.pixels != [64][64]byte{} {
+		t.Error("expected 0230 to clear the screen")
+	}
+
+	// 00E0 clears the bottom half of the HIRES screen too
+	vm.pixels[10][50] = 1
+	execute(vm, 0x00E0)
+	if vm.pixels != [64][64]byte{} {
+		t.Error("expected 00E0 to clear the whole HIRES screen")
+	}
+
+	// Without the startup code, detection leaves the ROM alone
+	vm = newTestVM()
+	WithHires(HiresDetect)(vm)
+	if err := vm.LoadROMBytes([]byte{0x12, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if vm.hires {
+		t.Error("expected a standard ROM not to be run in HIRES mode")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	vm := newTestVM()
+	WithQuirkWarnings(true)(vm)
+	execute(vm, 0x8126)
+	vm.SetLogger(log.New(&buf, "", 0))
+	vm.SetLogLevel(LogError)
+	execute(vm, 0x8126)
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing logged, got %q", buf.String())
+	}
+
+	vm.quirksWarned = nil
+	vm.SetLogLevel(LogWarn)
+	execute(vm, 0x8126)
+	want := "warning: quirk: 8126 at 0x204 depends on the ShiftInPlace quirk, which is false\n"
+	if buf.String() != want {
+		t.Errorf("expected %q logged, got %q", want, buf.String())
+	}
+}
+
+func TestIgnoreUnknown00NN(t *testing.T) {
+	var buf bytes.Buffer
+	vm := newTestVM()
+	WithIgnoreUnknown00NN(true)(vm)
+	vm.SetLogger(log.New(&buf, "", 0))
+	execute(vm, 0x00FA)
+	execute(vm, 0x00FA)
+	if vm.stopErr != nil {
+		t.Fatalf("expected the opcode to be ignored, got %v", vm.stopErr)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x204)})
+	want := "warning: ignoring unknown opcode 00FA at 0x200\n"
+	if buf.String() != want {
+		t.Errorf("expected %q logged once, got %q", want, buf.String())
+	}
+
+	// Machine code routines are still ignored silently
+	execute(vm, 0x0123)
+	if vm.stopErr != nil || buf.String() != want {
+		t.Errorf("expected 0123 to be ignored silently, got error %v and log %q", vm.stopErr, buf.String())
+	}
+}
+
+func TestUnknownFXNN(t *testing.T) {
+	vm := newTestVM()
+	execute(vm, 0xF130)
+	if !errors.Is(vm.stopErr, ErrUnknownOpcode) {
+		t.Fatalf("expected ErrUnknownOpcode from F130, got %v", vm.stopErr)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x200)})
+
+	var buf bytes.Buffer
+	vm = newTestVM()
+	WithIgnoreUnknownFXNN(true)(vm)
+	vm.SetLogger(log.New(&buf, "", 0))
+	execute(vm, 0xF130)
+	execute(vm, 0xF130)
+	// FX3A is unknown unless XO-CHIP is enabled
+	execute(vm, 0xF23A)
+	if vm.stopErr != nil {
+		t.Fatalf("expected the opcodes to be ignored, got %v", vm.stopErr)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x206)})
+	want := "warning: ignoring unknown opcode F130 at 0x200\nwarning: ignoring unknown opcode F23A at 0x204\n"
+	if buf.String() != want {
+		t.Errorf("expected %q logged, got %q", want, buf.String())
+	}
+}
+
+func TestExit(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMAt([]byte{0x61, 0x05, 0x00, 0xFD, 0x61, 0x06}, 0x200); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(10); err != ErrHalt {
+		t.Errorf("expected RunCycles to stop with ErrHalt, got %v", err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x05}, pc: addr(0x202)})
+
+	if err := vm.runCycle(); err != ErrHalt {
+		t.Errorf("expected ErrHalt from running 00FD, got %v", err)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x202)})
+}
+
+func TestDiffMemory(t *testing.T) {
+	vm := newTestVM()
+	before := vm.Snapshot()
+	vm.index = 0x300
+	vm.variables[0], vm.variables[1] = 0x11, 0x22
+	execute(vm, 0xF155)
+	after := vm.Snapshot()
+
+	// The opcode itself was written to memory at 0x200 too
+	want := []MemDiff{
+		{Addr: 0x200, Before: 0, After: 0xF1},
+		{Addr: 0x201, Before: 0, After: 0x55},
+		{Addr: 0x300, Before: 0, After: 0x11},
+		{Addr: 0x301, Before: 0, After: 0x22},
+	}
+	if got := DiffMemory(before, after); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected diff %v, got %v", want, got)
+	}
+	if got := DiffMemory(after, after); got != nil {
+		t.Errorf("expected no diff between identical snapshots, got %v", got)
+	}
+}
+
+func TestPCPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy PCPolicy
+		err    error
+		pc     uint16
+	}{
+		{"error", PCError, ErrPCOutOfBounds, 0xFFF},
+		{"wrap", PCWrap, nil, 0x202},
+		{"halt", PCHalt, nil, 0xFFF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := newTestVM()
+			WithPCPolicy(tc.policy)(vm)
+			vm.pc = 0xFFF
+			err := vm.RunCycles(1)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+			AssertState(t, vm, StateSpec{pc: addr(tc.pc)})
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x61, 0x05, 0xA3, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	vm.RunCycles(2)
+	vm.pixels[0][0] = 1
+
+	vm.Reset()
+	AssertState(t, vm, StateSpec{
+		registers: map[int]uint8{1: 0},
+		memory:    map[uint16][]byte{0x200: {0, 0, 0, 0}},
+		pc:        addr(0x200),
+	})
+	if vm.index != 0 || vm.pixels[0][0] != 0 || vm.romSize != 0 {
+		t.Error("expected the index, screen and ROM size to be reset")
+	}
+}
+
+// TestSupportedOpcodes checks that an example of each opcode form listed as supported executes
+// without a panic, and is classified and disassembled as that form
+func TestSupportedOpcodes(t *testing.T) {
+	// The example's operands, as Disassemble writes them
+	operands := map[string]string{"VX": "V1", "VY": "V2", "N": "3", "NN": "0x33", "NNN": "0x333"}
+	operand := regexp.MustCompile(`\b(VX|VY|N|NN|NNN)\b`)
+	seen := map[string]bool{}
+	for _, info := range SupportedOpcodes() {
+		if seen[info.Form] {
+			t.Errorf("%s listed twice", info.Form)
+		}
+		seen[info.Form] = true
+
+		example := strings.NewReplacer("X", "1", "Y", "2", "N", "3").Replace(info.Form)
+		var opcode uint16
+		if _, err := fmt.Sscanf(example, "%04X", &opcode); err != nil {
+			t.Fatalf("%s: %v", info.Form, err)
+		}
+		if form := opcodeForm(opcode); form != info.Form {
+			t.Errorf("example %04X of %s has form %s", opcode, info.Form, form)
+		}
+		want := operand.ReplaceAllStringFunc(info.Mnemonic, func(name string) string {
+			return operands[name]
+		})
+		if got := Disassemble(opcode); got != want {
+			t.Errorf("example %04X of %s disassembles as %q, want %q", opcode, info.Form, got, want)
+		}
+		t.Run(info.Form, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("executing %04X panicked: %v", opcode, r)
+				}
+			}()
+			vm := newTestVM()
+			vm.xoChip = true
+			execute(vm, opcode)
+		})
+	}
+}
+
+func TestBeepOnCollision(t *testing.T) {
+	beeps := 0
+	vm := newTestVM()
+	WithBeepOnCollision(func() { beeps++ })(vm)
+	vm.index = 0x300
+	vm.memory[0x300] = 0xFF
+	execute(vm, 0xD011)
+	if beeps != 0 {
+		t.Errorf("expected no beep drawing onto a blank screen, got %d", beeps)
+	}
+	execute(vm, 0xD011)
+	if beeps != 1 {
+		t.Errorf("expected a beep when the sprite collides, got %d", beeps)
+	}
+}
+
+func TestROMHash(t *testing.T) {
+	vm := newTestVM()
+	if vm.ROMHash() != "" {
+		t.Errorf("expected no hash before loading a ROM, got %q", vm.ROMHash())
+	}
+	if err := vm.LoadROM("../../roms/IBM_Logo.ch8"); err != nil {
+		t.Fatal(err)
+	}
+	if vm.ROMName() != "IBM_Logo.ch8" || vm.ROMSize() != 132 {
+		t.Errorf("expected IBM_Logo.ch8 of 132 bytes, got %q of %d", vm.ROMName(), vm.ROMSize())
+	}
+	hash := vm.ROMHash()
+	if len(hash) != 40 {
+		t.Errorf("expected a SHA-1 hex hash, got %q", hash)
+	}
+
+	// The hash identifies the contents, whatever the ROM is called
+	data, err := ioutil.ReadFile("../../roms/IBM_Logo.ch8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestVM()
+	if err := other.LoadROMBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	if other.ROMHash() != hash || other.ROMName() != "" {
+		t.Errorf("expected hash %s and no name, got %s and %q", hash, other.ROMHash(), other.ROMName())
+	}
+	if err := other.LoadROMBytes([]byte{0x00, 0xE0}); err != nil {
+		t.Fatal(err)
+	}
+	if other.ROMHash() == hash {
+		t.Error("expected a different ROM to have a different hash")
+	}
+}
+
+func TestLoadROMURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rom.ch8":
+			w.Write([]byte{0x61, 0x05})
+		case "/huge.ch8":
+			w.Write(make([]byte, MaxROMSize+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	vm := newTestVM()
+	if err := vm.LoadROMURL(server.URL + "/rom.ch8"); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x200: {0x61, 0x05}}})
+	if vm.ROMSize() != 2 {
+		t.Errorf("expected ROM size 2, got %d", vm.ROMSize())
+	}
+	if vm.ROMName() != "rom.ch8" {
+		t.Errorf("expected ROM name rom.ch8, got %q", vm.ROMName())
+	}
+
+	if err := vm.LoadROMURL(server.URL + "/missing.ch8"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+	if err := vm.LoadROMURL(server.URL + "/huge.ch8"); err == nil || !strings.Contains(err.Error(), "larger") {
+		t.Errorf("expected an error for an oversized ROM, got %v", err)
+	}
+}
+
+func TestSuggestedClockSpeed(t *testing.T) {
+	vm := newTestVM()
+	// Each frame sets the delay timer, does 8 instructions of work then polls the delay timer
+	rom := []byte{0x61, 0x01, 0xF1, 0x15}
+	for i := 0; i < 8; i++ {
+		rom = append(rom, 0x72, 0x01)
+	}
+	rom = append(rom, 0xF0, 0x07, 0x30, 0x00, 0x12, 0x14, 0x12, 0x02)
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	// 12 cycles a frame, 60 frames a second, plus a quarter headroom
+	if got := vm.SuggestedClockSpeed(); got != 900 {
+		t.Errorf("expected a clock speed of 900, got %d", got)
+	}
+	if vm.pc != 0x200 || vm.variables[2] != 0 {
+		t.Error("expected calibration to leave the VM untouched")
+	}
+
+	// A ROM waiting for a key can't be calibrated
+	if err := vm.LoadROMBytes([]byte{0xF0, 0x0A}); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.SuggestedClockSpeed(); got != defaultClockSpeed {
+		t.Errorf("expected the default clock speed, got %d", got)
+	}
+
+	// Calibrating a ROM that uses CXNN doesn't consume the VM's random bytes
+	random := 0
+	WithRandomFunc(func() byte { random++; return 0 })(vm)
+	if err := vm.LoadROMBytes([]byte{0xC0, 0xFF, 0x12, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	vm.SuggestedClockSpeed()
+	if random != 0 {
+		t.Errorf("expected calibration to leave the VM's random source alone, took %d bytes", random)
+	}
+}
+
+func TestPauseTimers(t *testing.T) {
+	vm := newTestVM()
+	execute(vm, 0x6005)
+	execute(vm, 0xF015)
+	vm.PauseTimers()
+	vm.tickTimers()
+	execute(vm, 0x7001) // The CPU carries on while the timers are frozen
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{0: 6}})
+	if vm.delayTimer != 5 {
+		t.Errorf("expected the delay timer to be frozen at 5, got %d", vm.delayTimer)
+	}
+	if !vm.TimersPaused() {
+		t.Error("expected the timers to be reported paused")
+	}
+
+	vm.ResumeTimers()
+	vm.tickTimers()
+	if vm.delayTimer != 4 {
+		t.Errorf("expected the delay timer to count down once resumed, got %d", vm.delayTimer)
+	}
+}
+
+func TestLoadROMOverROM(t *testing.T) {
+	vm := newTestVM()
+	WithMemoryFill(FillOnes)(vm)
+	vm.Reset()
+	if err := vm.LoadROMBytes([]byte{0x61, 0x01, 0x62, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.LoadROMBytes([]byte{0x63, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	// The end of the larger ROM is cleared back to the fill
+	AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x200: {0x63, 0x03, 0xFF, 0xFF}}})
+
+	WithKeepMemoryOnLoad(true)(vm)
+	vm.LoadROMAt([]byte{0xAB}, 0x300)
+	if err := vm.LoadROMBytes([]byte{0x64, 0x04}); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x300: {0xAB}}})
+}
+
+func TestProtectReservedMemory(t *testing.T) {
+	vm := newTestVM()
+	vm.index = 0x1FE
+	execute(vm, 0xF255)
+	if vm.stopErr != nil {
+		t.Fatalf("expected reserved memory to be writable by default, got %v", vm.stopErr)
+	}
+
+	var logs bytes.Buffer
+	vm = newTestVM()
+	vm.SetLogger(log.New(&logs, "", 0))
+	WithProtectReservedMemory(ProtectLog)(vm)
+	vm.index, vm.variables[0] = 0x1FE, 0x42
+	execute(vm, 0xF033)
+	if vm.stopErr != nil || !strings.Contains(logs.String(), "reserved memory at 0x01fe") {
+		t.Errorf("expected the write to be logged, got error %v, log %q", vm.stopErr, logs.String())
+	}
+	AssertState(t, vm, StateSpec{memory: map[uint16][]byte{0x1FE: {0, 6, 6}}})
+
+	vm = newTestVM()
+	WithProtectReservedMemory(ProtectError)(vm)
+	vm.index = 0x100
+	execute(vm, 0xF155)
+	if !errors.Is(vm.stopErr, ErrReservedMemory) {
+		t.Errorf("expected ErrReservedMemory, got %v", vm.stopErr)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x200)})
+	// Reading reserved memory is fine
+	vm.stopErr = nil
+	execute(vm, 0xF165)
+	if vm.stopErr != nil {
+		t.Errorf("expected reads to be allowed, got %v", vm.stopErr)
+	}
+}
+
+func TestMemoryFill(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil, WithMemoryFill(FillOnes))
+	if vm.memory[0x300] != 0xFF || vm.variables[3] != 0xFF {
+		t.Errorf("expected memory and registers filled with 0xff, got %#02x and %#02x", vm.memory[0x300], vm.variables[3])
+	}
+
+	// The same seed fills the same bytes, after a reset too
+	WithMemoryFill(FillRandom(42))(vm)
+	vm.Reset()
+	first := vm.Snapshot()
+	vm.memory[0x300]++
+	vm.Reset()
+	if vm.Snapshot() != first {
+		t.Error("expected the same random fill from the same seed")
+	}
+
+	for _, s := range []string{"zero", "ones", "random:42"} {
+		f, err := ParseMemoryFill(s)
+		if err != nil || f.String() != s {
+			t.Errorf("expected %q to parse and print back, got %v (error %v)", s, f, err)
+		}
+	}
+	if _, err := ParseMemoryFill("sometimes"); err == nil {
+		t.Error("expected an error for an unknown fill")
+	}
+}
+
+func TestCurrentInstruction(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0xD0, 0x15}); err != nil {
+		t.Fatal(err)
+	}
+	in := vm.CurrentInstruction()
+	if in.Opcode != 0xD015 || in.Instr != 0xD000 || in.X != 0 || in.Y != 1 || in.N != 5 {
+		t.Errorf("expected DXYN to be decoded with X = 0, Y = 1, N = 5, got %+v", in)
+	}
+	if in.Mnemonic != "DRW V0, V1, 5" || !strings.HasPrefix(in.Description, "Draw the N byte sprite") {
+		t.Errorf("expected DRW's mnemonic and description, got %q, %q", in.Mnemonic, in.Description)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x200)})
+
+	// Extension opcodes have their own mnemonics too
+	if err := vm.LoadROMBytes([]byte{0xF2, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	in = vm.CurrentInstruction()
+	if in.Mnemonic != "PLANE 2" || in.Description != "Select the bit planes to draw to" {
+		t.Errorf("expected PLANE's mnemonic and description, got %q, %q", in.Mnemonic, in.Description)
+	}
+}
+
+func TestPeekOpcode(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x6A, 0x42}); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.PeekOpcode(); got != 0x6A42 {
+		t.Errorf("expected to peek 6A42, got %04X", got)
+	}
+	if got := vm.PeekDisassembly(); got != "LD VA, 0x42" {
+		t.Errorf("expected to peek LD VA, 0x42, got %q", got)
+	}
+	// Peeking doesn't execute anything
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{0xA: 0x00}, pc: addr(0x200)})
+
+	// The last opcode in memory can be peeked, but a PC on the very last byte is out of bounds
+	vm.memory[0xFFE], vm.memory[0xFFF] = 0x00, 0xE0
+	vm.pc = 0xFFE
+	if got := vm.PeekDisassembly(); got != "CLS" {
+		t.Errorf("expected to peek CLS at the end of memory, got %q", got)
+	}
+	vm.pc = 0xFFF
+	if got := vm.PeekOpcode(); got != 0 {
+		t.Errorf("expected 0 past the end of memory, got %04X", got)
+	}
+	if got := vm.PeekDisassembly(); got != "DW 0x0000" {
+		t.Errorf("expected DW 0x0000 past the end of memory, got %q", got)
+	}
+}
+
+func TestDisassembleWindow(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x61, 0x01, 0x62, 0x02, 0x63, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	vm.pc = 0x202
+	lines := vm.DisassembleWindow(1, 1)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %v", lines)
+	}
+	if lines[1].Addr != 0x202 || !lines[1].Current || lines[0].Current || lines[1].Bytes != [2]byte{0x62, 0x02} {
+		t.Errorf("expected the middle line to be the current instruction, got %v", lines)
+	}
+	if got := lines[1].String(); got != "> 0x0202  62 02  LD V2, 0x02" {
+		t.Errorf("unexpected line %q", got)
+	}
+
+	// The window is cut short at either end of memory
+	vm.pc = 0x002
+	if lines := vm.DisassembleWindow(3, 0); len(lines) != 2 || lines[0].Addr != 0 {
+		t.Errorf("expected the window to stop at address 0, got %v", lines)
+	}
+	vm.pc = 0xFFC
+	if lines := vm.DisassembleWindow(0, 3); len(lines) != 2 || lines[1].Addr != 0xFFE {
+		t.Errorf("expected the window to stop at the end of memory, got %v", lines)
+	}
+}
+
+func TestDrawCycleCost(t *testing.T) {
+	vm := newTestVM()
+	WithDrawCycleCost(3)(vm)
+	if err := vm.LoadROMBytes([]byte{0xD0, 0x01, 0x71, 0x01, 0x71, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	// The draw takes 4 cycles, leaving 1 for the next instruction
+	if err := vm.RunCycles(5); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 1}})
+	if vm.pc != 0x204 {
+		t.Errorf("expected the PC to be 0x204, got %#04x", vm.pc)
+	}
+}
+
+func TestExecuteOpcode(t *testing.T) {
+	vm := newTestVM()
+	vm.variables[1], vm.variables[2] = 3, 4
+	if err := vm.ExecuteOpcode(0x8124); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 7}, pc: addr(0x202)})
+	if vm.memory[0x200] != 0 {
+		t.Error("expected the opcode not to be written to memory")
+	}
+
+	// Memory accesses through the index register still use memory
+	vm.index = 0x300
+	vm.memory[0x300] = 0x42
+	if err := vm.ExecuteOpcode(0xF065); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{0: 0x42}})
+
+	var execErr *ExecError
+	if err := vm.ExecuteOpcode(0x5121); !errors.As(err, &execErr) || !errors.Is(err, ErrUnknownOpcode) || execErr.PC != 0x204 {
+		t.Errorf("expected an unknown opcode error at 0x204, got %v", err)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x204)})
+}
+
+func TestRunFor(t *testing.T) {
+	vm := newTestVM()
+	// A tight loop that never ends by itself
+	if err := vm.LoadROMBytes([]byte{0x12, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := vm.RunFor(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to run for about 50ms, ran for %v", elapsed)
+	}
+
+	// The ROM exiting first is reported as usual
+	if err := vm.LoadROMBytes([]byte{0x00, 0xFD}); err != nil {
+		t.Fatal(err)
+	}
+	vm.pc = 0x200
+	if err := vm.RunFor(time.Second); err != ErrHalt {
+		t.Errorf("expected ErrHalt, got %v", err)
+	}
+}
+
+// fakeWindow is a Renderer standing in for the display window, whose focus and closing are set by
+// the test while Run uses it
+type fakeWindow struct {
+	mu        sync.Mutex
+	unfocused bool
+	closed    bool
+	// Calls to Render, and the number after which the window closes itself if not 0
+	renders    int
+	closeAfter int
+	// Calls to UpdateInput, i.e. window events polled without rendering
+	updates int
+}
+
+func (w *fakeWindow) Render(pixels [64][32]byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.renders++
+	if w.renders == w.closeAfter {
+		w.closed = true
+	}
+}
+
+func (w *fakeWindow) UpdateInput() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.updates++
+}
+
+func (w *fakeWindow) Focused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.unfocused
+}
+
+func (w *fakeWindow) Closed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+// set changes the window's state with fn, e.g. to take focus away
+func (w *fakeWindow) set(fn func(w *fakeWindow)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fn(w)
+}
+
+// waitFor waits up to a second for cond to become true, failing the test with what otherwise
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestPauseOnBlur(t *testing.T) {
+	window := &fakeWindow{}
+	vm := &VM{}
+	vm.Init(window, WithPauseOnBlur(true))
+	if err := vm.LoadROMBytes([]byte{0x12, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- vm.Run()
+	}()
+
+	window.set(func(w *fakeWindow) { w.unfocused = true })
+	waitFor(t, "the VM to pause when the window loses focus", vm.Paused)
+	// Window events are still polled while paused, which is how focus returning is noticed
+	window.set(func(w *fakeWindow) { w.updates = 0 })
+	waitFor(t, "window events to be polled while paused", func() bool {
+		updates := 0
+		window.set(func(w *fakeWindow) { updates = w.updates })
+		return updates > 0
+	})
+	window.set(func(w *fakeWindow) { w.unfocused = false })
+	waitFor(t, "the VM to resume when focus returns", func() bool { return !vm.Paused() })
+
+	window.set(func(w *fakeWindow) { w.closed = true })
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWindowClosed(t *testing.T) {
+	window := &fakeWindow{closeAfter: 3}
+	spy := &spyBeeper{}
+	vm := &VM{}
+	vm.Init(window, WithAudio(spy))
+	rom := []byte{
+		0x60, 0xFF, // LD V0, 0xFF
+		0xF0, 0x18, // LD ST, V0
+		0xD0, 0x05, // DRW V0, V0, 5
+		0x12, 0x04, // JP 0x204
+	}
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the window ends the run cleanly, long before the time limit, silencing the beep
+	start := time.Now()
+	if err := vm.RunFor(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Run to return once the window closed, ran for %v", elapsed)
+	}
+	if got := strings.Join(spy.calls, ","); got != "start 440,stop" {
+		t.Errorf("expected the beep to stop when the window closed, got %s", got)
+	}
+}
+
+func TestDrawThrottle(t *testing.T) {
+	// A ROM that draws as fast as the clock allows
+	rom := []byte{
+		0xD0, 0x05, // DRW V0, V0, 5
+		0x12, 0x00, // JP 0x200
+	}
+	run := func(throttle bool, d time.Duration) (*VM, int) {
+		window := &fakeWindow{}
+		vm := &VM{}
+		vm.Init(window, WithClockSpeed(6000), WithDrawThrottle(throttle))
+		if err := vm.LoadROMBytes(rom); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.RunFor(d); err != nil {
+			t.Fatal(err)
+		}
+		return vm, window.renders
+	}
+
+	if _, renders := run(false, 100*time.Millisecond); renders < 100 {
+		t.Errorf("expected every draw to be rendered without the throttle, got %d renders", renders)
+	}
+	// Throttled, at most one draw is rendered per 60Hz frame. DrawsPerSecond needs a second
+	// of running to measure
+	vm, renders := run(true, 1100*time.Millisecond)
+	if renders == 0 || renders > 68 {
+		t.Errorf("expected at most about 66 renders in 1.1s, got %d", renders)
+	}
+	if rate := vm.DrawsPerSecond(); rate <= 0 || rate > 61 {
+		t.Errorf("expected at most 60 draws per second, got %v", rate)
+	}
+}
+
+func TestEmulationSpeed(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil, WithClockSpeed(600))
+	if err := vm.LoadROMBytes([]byte{0x12, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if speed := vm.EmulationSpeed(); speed != 0 {
+		t.Errorf("expected no speed before running, got %v", speed)
+	}
+	// The speed is measured over a second of running, and a tight loop easily keeps up
+	if err := vm.RunFor(1100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if speed := vm.EmulationSpeed(); speed < 0.9 || speed > 1.1 {
+		t.Errorf("expected to run at about full speed, got %v", speed)
+	}
+}
+
+func TestStartPaused(t *testing.T) {
+	vm := &VM{}
+	vm.Init(nil, WithStartPaused(true))
+	if err := vm.LoadROMBytes([]byte{0x61, 0x05, 0x00, 0xFD}); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing runs until the VM is stepped or resumed
+	if err := vm.RunFor(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !vm.Paused() {
+		t.Error("expected the VM to start paused")
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x00}, pc: addr(0x200)})
+
+	vm.Step()
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x05}, pc: addr(0x202)})
+	vm.Resume()
+	if err := vm.RunFor(time.Second); err != ErrHalt {
+		t.Errorf("expected ErrHalt once resumed, got %v", err)
+	}
+}
+
+func TestPauseOnUnimplemented(t *testing.T) {
+	vm := newTestVM()
+	WithPauseOnUnimplemented(true)(vm)
+	if err := vm.LoadROMBytes([]byte{0x61, 0x01, 0x51, 0x21, 0x62, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(3); err != nil {
+		t.Fatal(err)
+	}
+	if !vm.Paused() || vm.pc != 0x202 {
+		t.Fatalf("expected to pause at the unknown opcode at 0x202, paused %v at %#04x", vm.Paused(), vm.pc)
+	}
+	// Stepping onto it reports the error
+	if err := vm.Step(); !errors.Is(err, ErrUnknownOpcode) {
+		t.Errorf("expected stepping to return ErrUnknownOpcode, got %v", err)
+	}
+
+	vm.Skip()
+	if err := vm.Step(); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{2: 2}})
+}
+
+func TestFrameHook(t *testing.T) {
+	vm := newTestVM()
+	var frames [][64][32]byte
+	vm.SetFrameHook(func(pixels [64][32]byte) { frames = append(frames, pixels) })
+	if err := vm.LoadROMBytes([]byte{0xA2, 0x06, 0xD0, 0x01, 0x12, 0x04, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0][0][0] != 1 {
+		t.Fatalf("expected one frame with the sprite drawn, got %d frames", len(frames))
+	}
+	// The hook is given a copy
+	frames[0][0][0] = 0
+	if vm.pixels[0][0] != 1 {
+		t.Error("expected the hook's frame to be a copy of the screen")
+	}
+}
+
+func TestStepN(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x71, 0x01, 0x71, 0x01, 0x71, 0x01, 0x71, 0x01, 0x00, 0xEE}); err != nil {
+		t.Fatal(err)
+	}
+	vm.AddBreakpoint(0x206)
+	if n, err := vm.StepN(5); n != 3 || err != nil {
+		t.Errorf("expected 3 steps before the breakpoint, got %d (error %v)", n, err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 3}})
+
+	// Stepping from the breakpoint executes it, then stops at the error
+	n, err := vm.StepN(5)
+	if n != 1 || !errors.Is(err, ErrStackUnderflow) {
+		t.Errorf("expected 1 step then a stack underflow, got %d (error %v)", n, err)
+	}
+	AssertState(t, vm, StateSpec{pc: addr(0x208)})
+}
+
+func TestDrawDryRun(t *testing.T) {
+	vm := newTestVM()
+	var events []DrawEvent
+	WithDrawDryRun(func(e DrawEvent) { events = append(events, e) })(vm)
+	vm.index = 0x300
+	vm.memory[0x300] = 0x81 // Pixels at x + 0 and x + 7
+	vm.variables[0], vm.variables[1] = 60, 5
+	execute(vm, 0xD011)
+	if vm.pixels != [64][64]byte{} {
+		t.Error("expected nothing to be drawn")
+	}
+	want := []DrawEvent{{PC: 0x200, X: 60, Y: 5, Pixels: []SpritePixel{
+		{Plane: 1, X: 60, Y: 5, ScreenX: 60, ScreenY: 5},
+		{Plane: 1, X: 67, Y: 5, ScreenX: 67, ScreenY: 5, Clipped: true},
+	}}}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("expected events %v, got %v", want, events)
+	}
+
+	vm.quirks.SpriteWrap = true
+	execute(vm, 0xD011)
+	if p := events[1].Pixels[1]; !p.Wrapped || p.Clipped || p.ScreenX != 3 {
+		t.Errorf("expected the pixel to wrap to x = 3, got %+v", p)
+	}
+}
+
+func TestCollisionEvents(t *testing.T) {
+	vm := newTestVM()
+	// Draw a 4 pixel sprite three times at (0, 0): only the second draw collides
+	rom := []byte{0xA2, 0x08, 0xD0, 0x11, 0xD0, 0x11, 0xD0, 0x11, 0xF0}
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(4); err != nil {
+		t.Fatal(err)
+	}
+	if events := vm.CollisionEvents(); len(events) != 0 {
+		t.Errorf("expected no events unless enabled, got %v", events)
+	}
+
+	vm.Reset()
+	WithCollisionLog(true)(vm)
+	if err := vm.LoadROMBytes(rom); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(4); err != nil {
+		t.Fatal(err)
+	}
+	want := []CollisionEvent{{Cycle: 2, PC: 0x204, X: 0, Y: 0, Erased: 4}}
+	if events := vm.CollisionEvents(); fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("expected events %v, got %v", want, events)
+	}
+	vm.ClearCollisionEvents()
+	if events := vm.CollisionEvents(); len(events) != 0 {
+		t.Errorf("expected no events after clearing, got %v", events)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	vm := newTestVM()
+	WithClockSpeed(1000)(vm)
+	if err := vm.LoadROMBytes([]byte{0x12, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(500); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.EmulatedTime(); got != 500*time.Millisecond {
+		t.Errorf("expected 500 cycles at 1000Hz to be 500ms, got %v", got)
+	}
+	if got := vm.Uptime(); got != 0 {
+		t.Errorf("expected no uptime without Run, got %v", got)
+	}
+
+	if err := vm.RunFor(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.Uptime(); got < 50*time.Millisecond || got > time.Second {
+		t.Errorf("expected an uptime of about 50ms, got %v", got)
+	}
+	// Time not running isn't counted
+	before := vm.Uptime()
+	time.Sleep(10 * time.Millisecond)
+	if got := vm.Uptime(); got != before {
+		t.Errorf("expected the uptime to stay at %v while stopped, got %v", before, got)
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	vm := newTestVM()
+	if err := vm.LoadROMBytes([]byte{0x61, 0x2A, 0xA2, 0x00, 0x22, 0x08}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunCycles(3); err != nil {
+		t.Fatal(err)
+	}
+	vm.pixels[10][20] = 3
+	vm.delayTimer = 7
+	var buf bytes.Buffer
+	if err := vm.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestVM()
+	if err := loaded.LoadState(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Snapshot() != vm.Snapshot() {
+		t.Error("expected the loaded state to match the saved one")
+	}
+
+	if err := loaded.LoadState(strings.NewReader(`{"version": 99}`)); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+	if err := loaded.LoadState(strings.NewReader(`{"version": 1, "memory": "AAAA"}`)); err == nil {
+		t.Error("expected an error for a malformed state")
+	}
+	for _, c := range []struct{ name, field, bad string }{
+		{"stack pointer", `"sp":1,`, `"sp":200,`},
+		{"ROM size", `"rom_size":6,`, `"rom_size":4000,`},
+		{"negative ROM size", `"rom_size":6,`, `"rom_size":-1,`},
+		{"sound hold", `"sound_hold":0,`, `"sound_hold":-1,`},
+		{"selected plane", `"selected_plane":1,`, `"selected_plane":9,`},
+	} {
+		corrupt := bytes.Replace(buf.Bytes(), []byte(c.field), []byte(c.bad), 1)
+		if bytes.Equal(corrupt, buf.Bytes()) {
+			t.Fatalf("expected the saved state to have %s to corrupt", c.field)
+		}
+		if err := loaded.LoadState(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("expected an error for a %s out of range", c.name)
+		}
+	}
+	if loaded.Snapshot() != vm.Snapshot() {
+		t.Error("expected a failed load to leave the VM unchanged")
+	}
+}
+
+func TestStartDelay(t *testing.T) {
+	vm := newTestVM()
+	WithStartDelayFrames(30)(vm)
+	if err := vm.LoadROMBytes([]byte{0x61, 0x01, 0x00, 0xFD}); err != nil {
+		t.Fatal(err)
+	}
+	// The deadline passes during the half second delay, before the ROM runs
+	if err := vm.RunFor(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x00}, pc: addr(0x200)})
+
+	WithStartDelayFrames(1)(vm)
+	if err := vm.RunFor(time.Second); err != ErrHalt {
+		t.Errorf("expected ErrHalt, got %v", err)
+	}
+	AssertState(t, vm, StateSpec{registers: map[int]uint8{1: 0x01}})
+}